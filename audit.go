@@ -0,0 +1,120 @@
+package nxusercheck
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	AuditCreate      = "create"
+	AuditAddTemplate = "addTemplate"
+	AuditDelTemplate = "delTemplate"
+	AuditSetTag      = "setTag"
+	AuditDelTag      = "delTag"
+	AuditDeleteUser  = "deleteUser"
+
+	AuditOutcomeOk    = "ok"
+	AuditOutcomeError = "error"
+)
+
+// AuditRecord describes a single mutation performed on a nexus user while
+// applying checks. Permissions are recorded as tags whose key starts with "@".
+type AuditRecord struct {
+	Time    time.Time   `json:"time"`
+	Actor   string      `json:"actor"`
+	User    string      `json:"user"`
+	Op      string      `json:"op"`
+	Prefix  string      `json:"prefix,omitempty"`
+	Key     string      `json:"key,omitempty"`
+	Old     interface{} `json:"old,omitempty"`
+	New     interface{} `json:"new,omitempty"`
+	Outcome string      `json:"outcome"`
+	Error   string      `json:"error,omitempty"`
+}
+
+type AuditSink interface {
+	Record(rec *AuditRecord) error
+}
+
+// AuditLog is an AuditSink writing records as JSON Lines.
+type AuditLog struct {
+	sync.Mutex
+	w io.Writer
+	c io.Closer
+}
+
+func NewAuditLog(w io.Writer) *AuditLog {
+	return &AuditLog{w: w}
+}
+
+func OpenAuditLog(file string) (*AuditLog, error) {
+	f, err := os.OpenFile(file, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("Error opening audit log %s: %s", file, err.Error())
+	}
+	return &AuditLog{w: f, c: f}, nil
+}
+
+func (al *AuditLog) Record(rec *AuditRecord) error {
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	al.Lock()
+	defer al.Unlock()
+	_, err = al.w.Write(append(line, '\n'))
+	return err
+}
+
+func (al *AuditLog) Close() error {
+	if al.c == nil {
+		return nil
+	}
+	return al.c.Close()
+}
+
+func (opts *CheckOpts) openAudit() (func(), error) {
+	if opts.Audit != nil || opts.AuditLog == "" {
+		return func() {}, nil
+	}
+	al, err := OpenAuditLog(opts.AuditLog)
+	if err != nil {
+		return nil, err
+	}
+	opts.Audit = al
+	return func() { al.Close() }, nil
+}
+
+func (opts *CheckOpts) audit(user string, op string, prefix string, key string, old interface{}, new interface{}, opErr error) error {
+	rec := &AuditRecord{
+		Time:    time.Now().UTC(),
+		Actor:   opts.AuditActor,
+		User:    user,
+		Op:      op,
+		Prefix:  prefix,
+		Key:     key,
+		Old:     old,
+		New:     new,
+		Outcome: AuditOutcomeOk,
+	}
+	if opErr != nil {
+		rec.Outcome = AuditOutcomeError
+		rec.Error = opErr.Error()
+	}
+	ur := opts.userReport(user)
+	ur.Applied = append(ur.Applied, rec)
+	if opts.Observer != nil {
+		opts.Observer.AfterApply(opts.check, rec)
+	}
+	if opts.Audit == nil {
+		return nil
+	}
+	if err := opts.Audit.Record(rec); err != nil {
+		return fmt.Errorf("Error writing audit record: %s", err.Error())
+	}
+	return nil
+}
@@ -0,0 +1,198 @@
+package nxusercheck
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// CheckBuilder builds a UsersCheck validating each value as it is added:
+//
+//	uc, err := NewCheck("test.myuser").
+//		Templates("test.mytemplate").
+//		Grant("test.mypath1", "@task.push", "@task.pull").
+//		Deny("test.mypath1", "@user.delete").
+//		Tag("test.mypath1", "tag2", 123).
+//		OnlySubUsers().
+//		Build()
+type CheckBuilder struct {
+	check *UsersCheck
+	errs  []error
+}
+
+func NewCheck(prefix string) *CheckBuilder {
+	b := &CheckBuilder{check: &UsersCheck{Prefix: prefix}}
+	if prefix == "" {
+		b.fail("empty prefix")
+	}
+	return b
+}
+
+func (b *CheckBuilder) fail(format string, a ...interface{}) {
+	b.errs = append(b.errs, fmt.Errorf("Error building check %s: %s", b.check.Prefix, fmt.Sprintf(format, a...)))
+}
+
+func (b *CheckBuilder) Name(name string) *CheckBuilder {
+	b.check.Name = name
+	return b
+}
+
+func (b *CheckBuilder) Templates(templates ...string) *CheckBuilder {
+	if b.check.Templates == nil {
+		b.check.Templates = []string{}
+	}
+	for _, tpl := range templates {
+		if tpl == "" {
+			b.fail("empty template")
+		} else if containsString(b.check.Templates, tpl) {
+			b.fail("duplicated template %s", tpl)
+		} else {
+			b.check.Templates = append(b.check.Templates, tpl)
+		}
+	}
+	return b
+}
+
+func (b *CheckBuilder) Grant(prefix string, perms ...string) *CheckBuilder {
+	return b.permissions(prefix, perms, true)
+}
+
+func (b *CheckBuilder) Deny(prefix string, perms ...string) *CheckBuilder {
+	return b.permissions(prefix, perms, false)
+}
+
+func (b *CheckBuilder) permissions(prefix string, perms []string, value bool) *CheckBuilder {
+	if prefix == "" {
+		b.fail("empty permission prefix")
+		return b
+	}
+	if b.check.Permissions == nil {
+		b.check.Permissions = &Permissions{ByPrefix: P{}}
+	}
+	for _, perm := range perms {
+		if !strings.HasPrefix(perm, "@") || len(perm) == 1 {
+			b.fail("invalid permission %s on %s: permissions start with @", perm, prefix)
+			continue
+		}
+		pvals := b.check.Permissions.ByPrefix[prefix]
+		if pvals == nil {
+			pvals = map[string]bool{}
+			b.check.Permissions.ByPrefix[prefix] = pvals
+		}
+		if cur, ok := pvals[perm]; ok && cur != value {
+			b.fail("permission %s on %s both granted and denied", perm, prefix)
+			continue
+		}
+		pvals[perm] = value
+	}
+	return b
+}
+
+func (b *CheckBuilder) Tag(prefix string, tag string, value interface{}) *CheckBuilder {
+	if prefix == "" {
+		b.fail("empty tag prefix")
+		return b
+	}
+	if tag == "" {
+		b.fail("empty tag on %s", prefix)
+		return b
+	}
+	if strings.HasPrefix(tag, "@") {
+		b.fail("tag %s on %s is a permission: use Grant or Deny", tag, prefix)
+		return b
+	}
+	if _, err := json.Marshal(value); err != nil {
+		b.fail("invalid value for tag %s on %s: %s", tag, prefix, err.Error())
+		return b
+	}
+	if b.check.Tags == nil {
+		b.check.Tags = &Tags{ByPrefix: T{}}
+	}
+	tvals := b.check.Tags.ByPrefix[prefix]
+	if tvals == nil {
+		tvals = map[string]interface{}{}
+		b.check.Tags.ByPrefix[prefix] = tvals
+	}
+	if cur, ok := tvals[tag]; ok && !reflect.DeepEqual(normalizeValue(cur), normalizeValue(value)) {
+		b.fail("conflicting values for tag %s on %s", tag, prefix)
+		return b
+	}
+	tvals[tag] = value
+	return b
+}
+
+func (b *CheckBuilder) Roles(roles ...string) *CheckBuilder {
+	b.check.Roles = append(b.check.Roles, roles...)
+	return b
+}
+
+func (b *CheckBuilder) Rule(rules ...Rule) *CheckBuilder {
+	for _, rule := range rules {
+		if rule == nil {
+			b.fail("nil rule")
+			continue
+		}
+		b.check.Rules = append(b.check.Rules, rule)
+	}
+	return b
+}
+
+func (b *CheckBuilder) Severity(kind string, category string, level string) *CheckBuilder {
+	sv := Severities{kind: {category: level}}
+	if err := sv.validate(); err != nil {
+		b.fail("%s", err.Error())
+		return b
+	}
+	if b.check.Severity == nil {
+		b.check.Severity = Severities{}
+	}
+	if b.check.Severity[kind] == nil {
+		b.check.Severity[kind] = map[string]string{}
+	}
+	b.check.Severity[kind][category] = level
+	return b
+}
+
+func (b *CheckBuilder) OnlySubUsers() *CheckBuilder {
+	b.check.OnlySubUsers = true
+	return b
+}
+
+func (b *CheckBuilder) CreateMissing(v bool) *CheckBuilder {
+	b.check.CreateMissing = Bool(v)
+	return b
+}
+
+func (b *CheckBuilder) AllowExtraTemplates(v bool) *CheckBuilder {
+	b.check.AllowExtraTemplates = Bool(v)
+	return b
+}
+
+func (b *CheckBuilder) NoExtraPermissions(v bool) *CheckBuilder {
+	b.check.NoExtraPermissions = Bool(v)
+	return b
+}
+
+func (b *CheckBuilder) NoExtraTags(v bool) *CheckBuilder {
+	b.check.NoExtraTags = Bool(v)
+	return b
+}
+
+// Build returns the check or all the errors found while building it.
+func (b *CheckBuilder) Build() (*UsersCheck, error) {
+	if len(b.errs) != 0 {
+		return nil, errors.Join(b.errs...)
+	}
+	return b.check, nil
+}
+
+// MustBuild is like Build but panics on error.
+func (b *CheckBuilder) MustBuild() *UsersCheck {
+	uc, err := b.Build()
+	if err != nil {
+		panic(err)
+	}
+	return uc
+}
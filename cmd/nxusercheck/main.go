@@ -0,0 +1,115 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	nuc "github.com/nayarsystems/nxusercheck"
+)
+
+func main() {
+	apply := flag.Bool("apply", false, "apply the changes")
+	validate := flag.Bool("validate", false, "only validate the config")
+	host := flag.String("nexus", "", "nexus host (overrides the config)")
+	user := flag.String("user", "", "nexus user")
+	pass := flag.String("pass", "", "nexus password")
+	output := flag.String("output", "", "output: text, diff, color, markdown or html")
+	tmpl := flag.String("template", "", "render the report with this text/template file")
+	env := flag.String("env", "", "comma separated environments of the config to run, or all")
+	snapshot := flag.String("snapshot", "", "save a snapshot of the users under these comma separated prefixes of -nexus to the file argument")
+	compare := flag.Bool("compare", false, "compare two snapshot files given as arguments")
+	migrate := flag.String("migrate", "", "copy the user from:to of -nexus")
+	subtree := flag.Bool("subtree", false, "with -migrate, also copy the sub users")
+	rewrite := flag.Bool("rewrite", false, "with -migrate, move the tags on prefixes under from to to")
+	overwrite := flag.Bool("overwrite", false, "with -migrate, overwrite existing users")
+	del := flag.Bool("delete", false, "with -migrate, delete the original users once copied")
+	interactive := flag.Bool("interactive", false, "confirm the changes of each user before applying them")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] config.json\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "       %s -snapshot prefixes -nexus host -user user -pass pass snapshot.json\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "       %s -migrate from:to [-apply] [-subtree] [-rewrite] [-delete] -nexus host -user user -pass pass\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "       %s -compare [-output diff] a.json b.json\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	nargs := 1
+	switch {
+	case *compare:
+		nargs = 2
+	case *migrate != "":
+		nargs = 0
+	}
+	if flag.NArg() != nargs {
+		flag.Usage()
+		os.Exit(2)
+	}
+	file := flag.Arg(0)
+
+	if *snapshot != "" {
+		s, err := nuc.TakeSnapshotNexus(*host, *user, *pass, strings.Split(*snapshot, ","))
+		if err == nil {
+			err = nuc.SaveSnapshot(s, file)
+		}
+		if err != nil {
+			fmt.Println(err.Error())
+			os.Exit(1)
+		}
+		fmt.Printf("%d users saved to %s\n", len(s.Users), file)
+		return
+	}
+
+	opts := &nuc.CheckOpts{Output: *output}
+	if *interactive {
+		opts.Confirm = nuc.PromptConfirm(os.Stdin, os.Stderr)
+	}
+	if *tmpl != "" {
+		text, err := ioutil.ReadFile(*tmpl)
+		if err != nil {
+			fmt.Printf("Error reading template %s: %s\n", *tmpl, err.Error())
+			os.Exit(1)
+		}
+		opts.Template = string(text)
+	}
+
+	var out string
+	var err error
+	switch {
+	case *migrate != "":
+		names := strings.SplitN(*migrate, ":", 2)
+		if len(names) != 2 {
+			flag.Usage()
+			os.Exit(2)
+		}
+		m := &nuc.Migration{From: names[0], To: names[1], Subtree: *subtree, RewritePrefixes: *rewrite, Overwrite: *overwrite, DeleteOriginals: *del}
+		if *apply {
+			out, err = nuc.Migrate(m, *host, *user, *pass, opts)
+		} else {
+			out, err = nuc.PlanMigration(m, *host, *user, *pass, opts)
+		}
+	case *compare:
+		out, err = nuc.CompareSnapshotFiles(file, flag.Arg(1), opts)
+	case *validate:
+		out, err = nuc.ValidateFile(file, opts)
+	case *env != "" && *apply:
+		out, err = nuc.ApplyFileEnv(file, strings.Split(*env, ","), opts)
+	case *env != "":
+		out, err = nuc.CheckFileEnv(file, strings.Split(*env, ","), opts)
+	case *host != "" && *apply:
+		out, err = nuc.ApplyFileNexus(file, *host, *user, *pass, opts)
+	case *host != "":
+		out, err = nuc.CheckFileNexus(file, *host, *user, *pass, opts)
+	case *apply:
+		out, err = nuc.ApplyFile(file, opts)
+	default:
+		out, err = nuc.CheckFile(file, opts)
+	}
+	if out != "" {
+		fmt.Println(out)
+	}
+	if err != nil {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,234 @@
+package nxusercheck
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"time"
+
+	nx "github.com/nayarsystems/nxgo/nxcore"
+)
+
+const KindUsers = "users"
+
+// Snapshot holds the users of a nexus under some prefixes (including the
+// prefixes themselves) to compare them with another nexus or snapshot.
+type Snapshot struct {
+	Name     string        `json:"name,omitempty"`
+	Time     time.Time     `json:"time"`
+	Prefixes []string      `json:"prefixes"`
+	Users    []nx.UserInfo `json:"users"`
+}
+
+func TakeSnapshot(nxconn *nx.NexusConn, prefixes []string, opts ...*CheckOpts) (*Snapshot, error) {
+	opt := firstOpts(opts)
+	snapshot := &Snapshot{Time: time.Now(), Prefixes: append([]string{}, prefixes...), Users: []nx.UserInfo{}}
+	seen := map[string]bool{}
+	for _, prefix := range prefixes {
+		var users []nx.UserInfo
+		err := opt.retry("", func() (err error) {
+			users, err = nxconn.UserList(prefix, 0, 0, &nx.ListOpts{})
+			return err
+		})
+		if err != nil {
+			return nil, fmt.Errorf("Error listing users on %s: %s", prefix, err.Error())
+		}
+		for _, user := range users {
+			if !seen[user.User] && underPrefix(user.User, prefix) {
+				seen[user.User] = true
+				snapshot.Users = append(snapshot.Users, user)
+			}
+		}
+	}
+	sort.Slice(snapshot.Users, func(i, j int) bool { return snapshot.Users[i].User < snapshot.Users[j].User })
+	return snapshot, nil
+}
+
+func TakeSnapshotNexus(nexusHost string, nexusUser string, nexusPass string, prefixes []string, opts ...*CheckOpts) (*Snapshot, error) {
+	nxconn, err := getNexusConn(nexusHost, nexusUser, nexusPass)
+	if err != nil {
+		return nil, err
+	}
+	defer nxconn.Close()
+	snapshot, err := TakeSnapshot(nxconn, prefixes, opts...)
+	if err != nil {
+		return nil, err
+	}
+	snapshot.Name = nexusHost
+	return snapshot, nil
+}
+
+func LoadSnapshot(file string) (*Snapshot, error) {
+	byteValue, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading file %s: %s", file, err.Error())
+	}
+	var snapshot *Snapshot
+	if err = json.Unmarshal(byteValue, &snapshot); err != nil {
+		return nil, fmt.Errorf("Error unmarshaling json from file %s: %s", file, err.Error())
+	}
+	if snapshot == nil {
+		return nil, fmt.Errorf("Error reading file %s: empty snapshot", file)
+	}
+	if snapshot.Name == "" {
+		snapshot.Name = file
+	}
+	return snapshot, nil
+}
+
+func SaveSnapshot(snapshot *Snapshot, file string) error {
+	byteValue, err := json.MarshalIndent(snapshot, "", "  ")
+	if err != nil {
+		return fmt.Errorf("Error marshaling snapshot: %s", err.Error())
+	}
+	if err = ioutil.WriteFile(file, byteValue, 0644); err != nil {
+		return fmt.Errorf("Error writing file %s: %s", file, err.Error())
+	}
+	return nil
+}
+
+// CompareNexusConn compares the users under prefixes of two nexus, see
+// CompareSnapshots.
+func CompareNexusConn(a *nx.NexusConn, b *nx.NexusConn, prefixes []string, opts ...*CheckOpts) (string, error) {
+	sa, err := TakeSnapshot(a, prefixes, opts...)
+	if err != nil {
+		return err.Error(), err
+	}
+	sb, err := TakeSnapshot(b, prefixes, opts...)
+	if err != nil {
+		return err.Error(), err
+	}
+	sa.Name, sb.Name = "a", "b"
+	return CompareSnapshots(sa, sb, opts...)
+}
+
+func CompareSnapshotFiles(fileA string, fileB string, opts ...*CheckOpts) (string, error) {
+	sa, err := LoadSnapshot(fileA)
+	if err != nil {
+		return err.Error(), err
+	}
+	sb, err := LoadSnapshot(fileB)
+	if err != nil {
+		return err.Error(), err
+	}
+	return CompareSnapshots(sa, sb, opts...)
+}
+
+// CompareSnapshots reports how the users under the prefixes of a differ in b,
+// as if a were the check of b: wrong values are the ones of b, missing ones
+// are only in a and extra ones only in b. Users only in one of them are
+// missing or extra users. The error lists the users that differ.
+func CompareSnapshots(a *Snapshot, b *Snapshot, opts ...*CheckOpts) (string, error) {
+	_, out, err := compareSnapshots(a, b, firstOpts(opts))
+	return out, err
+}
+
+func compareSnapshots(a *Snapshot, b *Snapshot, opts *CheckOpts) (*Report, string, error) {
+	report := newReport(false)
+	for _, prefix := range a.Prefixes {
+		if !containsString(b.Prefixes, prefix) {
+			err := fmt.Errorf("Error comparing snapshots: %s doesn't include %s", snapshotName(b, "b"), prefix)
+			report.Error = err.Error()
+			return report, err.Error(), err
+		}
+	}
+	usersA, usersB := snapshotUsers(a), snapshotUsers(b)
+	outs := []string{}
+	differ := []string{}
+	for _, prefix := range a.Prefixes {
+		cr := &CheckReport{Name: "compare", Prefix: prefix, Users: []*UserReport{}}
+		report.Checks = append(report.Checks, cr)
+		names := []string{}
+		for _, users := range []map[string]*nx.UserInfo{usersA, usersB} {
+			for name := range users {
+				if underPrefix(name, prefix) && !containsString(names, name) {
+					names = append(names, name)
+				}
+			}
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			ur := compareUser(name, usersA[name], usersB[name])
+			if len(ur.Findings) == 0 {
+				continue
+			}
+			cr.Users = append(cr.Users, ur)
+			if !containsString(differ, name) {
+				differ = append(differ, name)
+			}
+			fs := []string{}
+			for _, f := range ur.Findings {
+				fs = append(fs, "\t* "+formatFinding(f))
+			}
+			outs = append(outs, fmt.Sprintf("%s differs:\n\n%s\n", name, strings.Join(fs, "\n")))
+		}
+		outs = append(outs, fmt.Sprintf("%s: %d users compared, %d differ", prefix, len(names), len(cr.Users)))
+	}
+	report.Duration = time.Since(report.Start)
+	text := fmt.Sprintf("Comparing %s (wants) with %s (has)\n\n%s", snapshotName(a, "a"), snapshotName(b, "b"), strings.Join(outs, "\n"))
+	if opts.output() == OutputDiff {
+		ls := []string{}
+		for _, cr := range report.Checks {
+			for _, ur := range cr.Users {
+				ls = append(ls, formatUserDiff(ur))
+			}
+		}
+		text = strings.Join(ls, "\n")
+	}
+	if len(differ) != 0 {
+		err := fmt.Errorf("%d users differ: %s", len(differ), strings.Join(differ, ", "))
+		report.Error = err.Error()
+		return report, opts.render(report, text), err
+	}
+	return report, opts.render(report, text), nil
+}
+
+// compareUser reports the differences of user b from user a, any of them nil
+// when the user only exists in the other snapshot.
+func compareUser(name string, a *nx.UserInfo, b *nx.UserInfo) *UserReport {
+	ur := &UserReport{User: name, Findings: []*Finding{}}
+	switch {
+	case a == nil:
+		ur.Findings = append(ur.Findings, &Finding{Kind: KindUsers, Category: CategoryExtra, Severity: SeverityError, Key: name})
+		return ur
+	case b == nil:
+		ur.Findings = append(ur.Findings, &Finding{Kind: KindUsers, Category: CategoryMissing, Severity: SeverityError, Key: name})
+		return ur
+	}
+	wrongOrder, missing, extra := diffTemplates(b.Templates, a.Templates, false)
+	if wrongOrder {
+		ur.addTemplatesFinding(CategoryWrong, SeverityError, b.Templates, a.Templates)
+	}
+	for _, tpl := range missing {
+		ur.addTemplateFinding(CategoryMissing, SeverityError, tpl)
+	}
+	for _, tpl := range extra {
+		ur.addTemplateFinding(CategoryExtra, SeverityError, tpl)
+	}
+	wrong, missingTags, extraTags := checkTagsWithDeepEqual(getTagsOnly(b.Tags), getTagsOnly(a.Tags))
+	ur.addFindings(KindTags, SeverityError, wrong, missingTags, extraTags)
+	wrong, missingPerms, extraPerms := checkTagsAsPerms(getPermsOnly(b.Tags), getPermsOnly(a.Tags))
+	ur.addFindings(KindPermissions, SeverityError, wrong, missingPerms, extraPerms)
+	return ur
+}
+
+func snapshotUsers(s *Snapshot) map[string]*nx.UserInfo {
+	users := map[string]*nx.UserInfo{}
+	for i := range s.Users {
+		users[s.Users[i].User] = &s.Users[i]
+	}
+	return users
+}
+
+func snapshotName(s *Snapshot, name string) string {
+	if s.Name != "" {
+		return s.Name
+	}
+	return name
+}
+
+func underPrefix(user string, prefix string) bool {
+	return prefix == "" || user == prefix || strings.HasPrefix(user, prefix+".")
+}
@@ -0,0 +1,315 @@
+package nxusercheck
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// Config files are merged following the precedence rules described in README.md:
+// checks must not conflict, settings of a file override those of its includes
+// and sibling files must not define the same setting with different values.
+// Exemptions of all the files are concatenated.
+
+type configSetting struct {
+	value  json.RawMessage
+	source string
+}
+
+type configCheck struct {
+	raw    json.RawMessage
+	check  *UsersCheck
+	source string
+}
+
+type config struct {
+	checks     []*configCheck
+	exemptions []json.RawMessage
+	settings   map[string]*configSetting
+}
+
+type configLoader struct {
+	loading map[string]bool
+	files   []string
+}
+
+func loadConfig(file string) (*userChecksFromFile, error) {
+	ucff, _, err := loadConfigFiles(file)
+	return ucff, err
+}
+
+func loadConfigFiles(file string) (*userChecksFromFile, []string, error) {
+	cl := &configLoader{loading: map[string]bool{}}
+	cfg, err := cl.load(file)
+	if err != nil {
+		return nil, cl.files, err
+	}
+	ucff, err := cfg.build()
+	return ucff, cl.files, err
+}
+
+func (cl *configLoader) load(file string) (*config, error) {
+	fi, err := os.Stat(file)
+	if err != nil {
+		return nil, fmt.Errorf("Error opening file %s: %s", file, err.Error())
+	}
+	cl.files = append(cl.files, file)
+	if !fi.IsDir() {
+		return cl.loadFile(file)
+	}
+	files, err := filepath.Glob(filepath.Join(file, "*.json"))
+	if err != nil {
+		return nil, fmt.Errorf("Error reading directory %s: %s", file, err.Error())
+	}
+	sort.Strings(files)
+	cfg := newConfig()
+	for _, f := range files {
+		cl.files = append(cl.files, f)
+		fcfg, err := cl.loadFile(f)
+		if err != nil {
+			return nil, err
+		}
+		if err = cfg.merge(fcfg, false); err != nil {
+			return nil, err
+		}
+	}
+	return cfg, nil
+}
+
+func (cl *configLoader) loadFile(file string) (*config, error) {
+	absFile, err := filepath.Abs(file)
+	if err != nil {
+		return nil, fmt.Errorf("Error opening file %s: %s", file, err.Error())
+	}
+	if cl.loading[absFile] {
+		return nil, fmt.Errorf("Error loading file %s: include cycle", file)
+	}
+	cl.loading[absFile] = true
+	defer delete(cl.loading, absFile)
+
+	byteValue, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading file %s: %s", file, err.Error())
+	}
+	var raw map[string]json.RawMessage
+	if err = json.Unmarshal(byteValue, &raw); err != nil {
+		return nil, fmt.Errorf("Error unmarshaling json from file %s: %s", file, err.Error())
+	}
+
+	own := newConfig()
+	included := newConfig()
+	for key, value := range raw {
+		switch key {
+		case "include":
+			var includes []string
+			if err = json.Unmarshal(value, &includes); err != nil {
+				return nil, fmt.Errorf("Error unmarshaling json from file %s: include: %s", file, err.Error())
+			}
+			for _, inc := range includes {
+				icfg, err := cl.loadInclude(file, inc)
+				if err != nil {
+					return nil, err
+				}
+				if err = included.merge(icfg, false); err != nil {
+					return nil, err
+				}
+			}
+		case "checks":
+			var checks []json.RawMessage
+			if err = json.Unmarshal(value, &checks); err != nil {
+				return nil, fmt.Errorf("Error unmarshaling json from file %s: checks: %s", file, err.Error())
+			}
+			for _, rawCheck := range checks {
+				var uc *UsersCheck
+				if err = json.Unmarshal(rawCheck, &uc); err != nil {
+					return nil, fmt.Errorf("Error unmarshaling json from file %s: checks: %s", file, err.Error())
+				}
+				if uc == nil {
+					continue
+				}
+				uc.source = file
+				// Checks of the same file are kept as they are
+				own.checks = append(own.checks, &configCheck{raw: rawCheck, check: uc, source: file})
+			}
+		case "exemptions":
+			var exemptions []json.RawMessage
+			if err = json.Unmarshal(value, &exemptions); err != nil {
+				return nil, fmt.Errorf("Error unmarshaling json from file %s: exemptions: %s", file, err.Error())
+			}
+			for _, rawExemption := range exemptions {
+				own.addExemption(rawExemption)
+			}
+		case "opts", "roles", "environments":
+			var section map[string]json.RawMessage
+			if err = json.Unmarshal(value, &section); err != nil {
+				return nil, fmt.Errorf("Error unmarshaling json from file %s: %s: %s", file, key, err.Error())
+			}
+			for sectionKey, sectionValue := range section {
+				own.settings[key+"."+sectionKey] = &configSetting{value: sectionValue, source: file}
+			}
+		default:
+			own.settings[key] = &configSetting{value: value, source: file}
+		}
+	}
+
+	if err = included.merge(own, true); err != nil {
+		return nil, err
+	}
+	return included, nil
+}
+
+func (cl *configLoader) loadInclude(file string, include string) (*config, error) {
+	pattern := include
+	if !filepath.IsAbs(pattern) {
+		pattern = filepath.Join(filepath.Dir(file), pattern)
+	}
+	matches, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("Error including %s from file %s: %s", include, file, err.Error())
+	}
+	if len(matches) == 0 {
+		return nil, fmt.Errorf("Error including %s from file %s: no such file or directory", include, file)
+	}
+	sort.Strings(matches)
+	cfg := newConfig()
+	for _, m := range matches {
+		mcfg, err := cl.load(m)
+		if err != nil {
+			return nil, err
+		}
+		if err = cfg.merge(mcfg, false); err != nil {
+			return nil, err
+		}
+	}
+	return cfg, nil
+}
+
+func newConfig() *config {
+	return &config{checks: []*configCheck{}, settings: map[string]*configSetting{}}
+}
+
+// sameCheck tells if two checks target the same users on the same
+// environments.
+func sameCheck(a *UsersCheck, b *UsersCheck) bool {
+	if a.Prefix != b.Prefix || a.OnlySubUsers != b.OnlySubUsers || len(a.Environments) != len(b.Environments) {
+		return false
+	}
+	for _, env := range a.Environments {
+		if !containsString(b.Environments, env) {
+			return false
+		}
+	}
+	return true
+}
+
+// addCheck adds a check of another file unless one of the merged checks is an
+// identical duplicate, failing when they are all different definitions.
+func (cfg *config) addCheck(cc *configCheck, merged []*configCheck) error {
+	var conflict *configCheck
+	for _, c := range merged {
+		if !sameCheck(c.check, cc.check) {
+			continue
+		}
+		if jsonEqual(c.raw, cc.raw) {
+			return nil
+		}
+		conflict = c
+	}
+	if conflict != nil {
+		return fmt.Errorf("Error merging config: conflicting definitions of check %s in %s and %s", cc.check.Prefix, conflict.source, cc.source)
+	}
+	cfg.checks = append(cfg.checks, cc)
+	return nil
+}
+
+func (cfg *config) addExemption(raw json.RawMessage) {
+	for _, e := range cfg.exemptions {
+		if jsonEqual(e, raw) {
+			return
+		}
+	}
+	cfg.exemptions = append(cfg.exemptions, raw)
+}
+
+func (cfg *config) merge(other *config, override bool) error {
+	merged := cfg.checks
+	for _, cc := range other.checks {
+		if err := cfg.addCheck(cc, merged); err != nil {
+			return err
+		}
+	}
+	for _, raw := range other.exemptions {
+		cfg.addExemption(raw)
+	}
+	keys := []string{}
+	for key := range other.settings {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		setting := other.settings[key]
+		if cur, ok := cfg.settings[key]; ok && !override && !jsonEqual(cur.value, setting.value) {
+			return fmt.Errorf("Error merging config: conflicting values for %s in %s and %s", key, cur.source, setting.source)
+		}
+		cfg.settings[key] = setting
+	}
+	return nil
+}
+
+func (cfg *config) build() (*userChecksFromFile, error) {
+	top := map[string]json.RawMessage{}
+	sections := map[string]map[string]json.RawMessage{}
+	for key, setting := range cfg.settings {
+		if i := strings.Index(key, "."); i >= 0 {
+			if sections[key[:i]] == nil {
+				sections[key[:i]] = map[string]json.RawMessage{}
+			}
+			sections[key[:i]][key[i+1:]] = setting.value
+		} else {
+			top[key] = setting.value
+		}
+	}
+	for name, section := range sections {
+		value, err := json.Marshal(section)
+		if err != nil {
+			return nil, fmt.Errorf("Error building config: %s", err.Error())
+		}
+		top[name] = value
+	}
+	if len(cfg.exemptions) != 0 {
+		value, err := json.Marshal(cfg.exemptions)
+		if err != nil {
+			return nil, fmt.Errorf("Error building config: %s", err.Error())
+		}
+		top["exemptions"] = value
+	}
+	byteValue, err := json.Marshal(top)
+	if err != nil {
+		return nil, fmt.Errorf("Error building config: %s", err.Error())
+	}
+	var ucff *userChecksFromFile
+	if err = json.Unmarshal(byteValue, &ucff); err != nil {
+		return nil, fmt.Errorf("Error unmarshaling json from config: %s", err.Error())
+	}
+	ucff.Checks = []*UsersCheck{}
+	for _, cc := range cfg.checks {
+		ucff.Checks = append(ucff.Checks, cc.check)
+	}
+	return ucff, nil
+}
+
+func jsonEqual(a, b json.RawMessage) bool {
+	var va, vb interface{}
+	if err := json.Unmarshal(a, &va); err != nil {
+		return false
+	}
+	if err := json.Unmarshal(b, &vb); err != nil {
+		return false
+	}
+	return reflect.DeepEqual(va, vb)
+}
@@ -0,0 +1,84 @@
+package nxusercheck
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+type Decision int
+
+const (
+	ConfirmAccept Decision = iota
+	ConfirmSkip
+	ConfirmAcceptAll
+	ConfirmAbort
+)
+
+var ErrAborted = errors.New("Apply aborted")
+
+// ConfirmFunc is asked before applying the planned changes of each user. It
+// can accept them, skip them, accept them and the rest of the users of the
+// check or abort the whole run. Skipped changes are listed in the report.
+type ConfirmFunc func(check *UsersCheck, user string, plan []*PlanOp) Decision
+
+// confirm asks whether to apply the plan of a user, reporting it as skipped
+// otherwise.
+func (opts *CheckOpts) confirm(ur *UserReport, plan []*PlanOp) (bool, error) {
+	if opts.Confirm == nil || opts.acceptAll {
+		return true, nil
+	}
+	switch opts.Confirm(opts.check, ur.User, plan) {
+	case ConfirmAccept:
+		return true, nil
+	case ConfirmAcceptAll:
+		opts.acceptAll = true
+		return true, nil
+	case ConfirmAbort:
+		opts.skip(ur, plan, "aborted")
+		return false, ErrAborted
+	default:
+		opts.skip(ur, plan, "skipped")
+		return false, nil
+	}
+}
+
+func (opts *CheckOpts) skip(ur *UserReport, plan []*PlanOp, reason string) {
+	for _, op := range plan {
+		skipped := *op
+		skipped.Reason = reason
+		ur.Skipped = append(ur.Skipped, &skipped)
+	}
+}
+
+// PromptConfirm returns a ConfirmFunc that shows the changes of each user on
+// out and reads the decision from in.
+func PromptConfirm(in io.Reader, out io.Writer) ConfirmFunc {
+	reader := bufio.NewReader(in)
+	return func(check *UsersCheck, user string, plan []*PlanOp) Decision {
+		fmt.Fprintf(out, "%s (%s) changes:\n", user, check.label())
+		for _, op := range plan {
+			fmt.Fprintf(out, "\t* %s\n", formatPlan([]*PlanOp{op}))
+		}
+		for {
+			fmt.Fprint(out, "Apply? [y]es, [n]o, [a]ll for this check, [q]uit: ")
+			line, err := reader.ReadString('\n')
+			switch strings.ToLower(strings.TrimSpace(line)) {
+			case "y", "yes":
+				return ConfirmAccept
+			case "n", "no":
+				return ConfirmSkip
+			case "a", "all":
+				return ConfirmAcceptAll
+			case "q", "quit":
+				return ConfirmAbort
+			}
+			if err != nil {
+				fmt.Fprintln(out)
+				return ConfirmAbort
+			}
+		}
+	}
+}
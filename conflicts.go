@@ -0,0 +1,236 @@
+package nxusercheck
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// Conflict is a contradictory requirement found before contacting nexus: the
+// same prefix and key (permission, tag or "templates") wanted with different
+// values by two sources of a check or by two checks targeting the same users,
+// or wanted by a check and removed as extra by another.
+type Conflict struct {
+	Prefix string       `json:"prefix,omitempty"`
+	Key    string       `json:"key"`
+	A      ConflictSide `json:"a"`
+	B      ConflictSide `json:"b"`
+}
+
+type ConflictSide struct {
+	Check  string      `json:"check"`
+	Source string      `json:"source"`
+	Value  interface{} `json:"value"`
+}
+
+func (c *Conflict) String() string {
+	on := ""
+	if c.Prefix != "" {
+		on = fmt.Sprintf(" on %s", c.Prefix)
+	}
+	return fmt.Sprintf("conflicting values for %s%s: %s in %s and %s in %s", c.Key, on, c.A.describe(), c.A.Check, c.B.describe(), c.B.Check)
+}
+
+func (cs ConflictSide) describe() string {
+	value := fmt.Sprintf("%v", cs.Value)
+	if jsval, err := json.Marshal(cs.Value); err == nil {
+		value = string(jsval)
+	}
+	if cs.Source == "" {
+		return value
+	}
+	return fmt.Sprintf("%s (%s)", value, cs.Source)
+}
+
+func Validate(checks []*UsersCheck, opts ...*CheckOpts) (string, error) {
+	return validateChecks(checks, firstOpts(opts))
+}
+
+func ValidateFile(file string, opts ...*CheckOpts) (string, error) {
+	ucff, err := loadConfig(file)
+	if err == nil {
+		err = ucff.validateEnvironments()
+	}
+	if err != nil {
+		return err.Error(), err
+	}
+	fileOpts := ucff.fileOpts()
+	out, err := validateChecks(ucff.defaultChecks(), layerOpts(fileOpts, firstOpts(opts)))
+	if err != nil || len(ucff.Environments) == 0 {
+		return out, err
+	}
+	outs := []string{out}
+	for _, name := range sortedKeys(ucff.Environments) {
+		target, err := ucff.environment(name, fileOpts)
+		if err != nil {
+			return err.Error(), err
+		}
+		if out, err = validateChecks(target.checks, layerOpts(target.opts, firstOpts(opts))); err != nil {
+			err = fmt.Errorf("Error in environment %s: %s", name, err.Error())
+			return err.Error(), err
+		}
+		outs = append(outs, fmt.Sprintf("%s environment: %s", name, out))
+	}
+	return strings.Join(outs, "\n"), nil
+}
+
+func validateChecks(checks []*UsersCheck, opts *CheckOpts) (string, error) {
+	if err := checkConflicts(checks, opts); err != nil {
+		return err.Error(), err
+	}
+	return fmt.Sprintf("%d checks without conflicts", len(checks)), nil
+}
+
+func checkConflicts(checks []*UsersCheck, opts *CheckOpts) error {
+	conflicts, err := analyzeConflicts(checks, opts)
+	if err != nil {
+		return err
+	}
+	if len(conflicts) != 0 {
+		return errors.New(formatConflicts(conflicts))
+	}
+	return nil
+}
+
+func analyzeConflicts(checks []*UsersCheck, opts *CheckOpts) ([]*Conflict, error) {
+	conflicts := []*Conflict{}
+	for _, uc := range checks {
+		if err := uc.prepare(opts); err != nil {
+			return nil, fmt.Errorf("Error initializing check %s: %s", uc.Prefix, err.Error())
+		}
+		conflicts = append(conflicts, uc.conflicts...)
+	}
+	for i, a := range checks {
+		for _, b := range checks[i+1:] {
+			if checksOverlap(a, b) {
+				conflicts = append(conflicts, crossConflicts(a, b, opts)...)
+			}
+		}
+	}
+	return conflicts, nil
+}
+
+func crossConflicts(a, b *UsersCheck, opts *CheckOpts) []*Conflict {
+	conflicts := []*Conflict{}
+	if a.fullTemplates != nil && b.fullTemplates != nil {
+		conflict := false
+		if !a.allowExtraTemplates(opts) && !b.allowExtraTemplates(opts) {
+			conflict = !checkTemplatesExactMatch(a.fullTemplates, b.fullTemplates)
+		} else if a.severity(opts, KindTemplates, CategoryExtra) == SeverityError {
+			_, ok := checkTemplatesOrderMatch(a.fullTemplates, b.fullTemplates)
+			conflict = !ok
+		} else if b.severity(opts, KindTemplates, CategoryExtra) == SeverityError {
+			_, ok := checkTemplatesOrderMatch(b.fullTemplates, a.fullTemplates)
+			conflict = !ok
+		}
+		if conflict {
+			conflicts = append(conflicts, &Conflict{
+				Key: "templates",
+				A:   ConflictSide{Check: a.label(), Value: a.fullTemplates},
+				B:   ConflictSide{Check: b.label(), Value: b.fullTemplates},
+			})
+		}
+	}
+	for _, kind := range []string{KindPermissions, KindTags} {
+		fullA, fullB := a.full(kind), b.full(kind)
+		for _, prefix := range sortedKeys(fullA) {
+			for _, key := range sortedKeys(fullA[prefix]) {
+				aval := fullA[prefix][key]
+				if bval, ok := fullB[prefix][key]; ok && !reflect.DeepEqual(aval, bval) {
+					id := prefix + " " + key
+					conflicts = append(conflicts, &Conflict{
+						Prefix: prefix,
+						Key:    key,
+						A:      ConflictSide{Check: a.label(), Source: a.sources[id], Value: aval},
+						B:      ConflictSide{Check: b.label(), Source: b.sources[id], Value: bval},
+					})
+				}
+			}
+		}
+		conflicts = append(conflicts, extraConflicts(a, b, kind, opts)...)
+		conflicts = append(conflicts, extraConflicts(b, a, kind, opts)...)
+	}
+	return conflicts
+}
+
+// extraConflicts returns the keys of a kind wanted by other that exact removes
+// as extra.
+func extraConflicts(exact, other *UsersCheck, kind string, opts *CheckOpts) []*Conflict {
+	conflicts := []*Conflict{}
+	fullExact, fullOther := exact.full(kind), other.full(kind)
+	if fullExact == nil || exact.severity(opts, kind, CategoryExtra) != SeverityError {
+		return conflicts
+	}
+	source := "noExtraTags"
+	if kind == KindPermissions {
+		source = "noExtraPermissions"
+	}
+	for _, prefix := range sortedKeys(fullOther) {
+		for _, key := range sortedKeys(fullOther[prefix]) {
+			if _, ok := fullExact[prefix][key]; !ok {
+				conflicts = append(conflicts, &Conflict{
+					Prefix: prefix,
+					Key:    key,
+					A:      ConflictSide{Check: exact.label(), Source: source},
+					B:      ConflictSide{Check: other.label(), Source: other.sources[prefix+" "+key], Value: fullOther[prefix][key]},
+				})
+			}
+		}
+	}
+	return conflicts
+}
+
+func (uc *UsersCheck) full(kind string) T {
+	if kind == KindPermissions {
+		return uc.fullPermissions
+	}
+	return uc.fullTags
+}
+
+func checksOverlap(a, b *UsersCheck) bool {
+	switch {
+	case !a.OnlySubUsers && !b.OnlySubUsers:
+		return a.Prefix == b.Prefix
+	case !a.OnlySubUsers:
+		return isSubUser(a.Prefix, b.Prefix)
+	case !b.OnlySubUsers:
+		return isSubUser(b.Prefix, a.Prefix)
+	default:
+		return a.Prefix == b.Prefix || isSubUser(a.Prefix, b.Prefix) || isSubUser(b.Prefix, a.Prefix)
+	}
+}
+
+func isSubUser(user string, prefix string) bool {
+	return strings.HasPrefix(user, prefix+".")
+}
+
+func (uc *UsersCheck) label() string {
+	label := "check " + uc.Prefix
+	if uc.OnlySubUsers {
+		label += " (sub users)"
+	}
+	if uc.source != "" {
+		label += " from " + uc.source
+	}
+	return label
+}
+
+func formatConflicts(conflicts []*Conflict) string {
+	ls := []string{"CONFLICTS:\n"}
+	for _, c := range conflicts {
+		ls = append(ls, fmt.Sprintf("\t* %s", c.String()))
+	}
+	return strings.Join(ls, "\n")
+}
+
+func sortedKeys(m interface{}) []string {
+	keys := []string{}
+	for _, k := range reflect.ValueOf(m).MapKeys() {
+		keys = append(keys, k.String())
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,287 @@
+package nxusercheck
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// AllEnvironments selects every environment of the config file.
+const AllEnvironments = "all"
+
+// Environment is a named nexus target of a config file. Its nexus settings
+// and opts override the ones of the file, and its checks replace the file
+// checks with the same prefix and onlySubUsers or are added to them. File
+// checks listing "environments" only run on those.
+type Environment struct {
+	NexusHost string          `json:"nexusHost"`
+	NexusUser string          `json:"nexusUser"`
+	NexusPass string          `json:"nexusPass"`
+	Opts      json.RawMessage `json:"opts"`
+	Checks    []*UsersCheck   `json:"checks"`
+}
+
+type environmentTarget struct {
+	name      string
+	checks    []*UsersCheck
+	opts      *CheckOpts
+	nexusHost string
+	nexusUser string
+	nexusPass string
+}
+
+// CheckFileEnv checks the environments of a config file (all of them when
+// envs is empty or "all") and returns the combined output.
+func CheckFileEnv(file string, envs []string, opts ...*CheckOpts) (string, error) {
+	_, out, err := runFileEnv(false, file, envs, firstOpts(opts))
+	return out, err
+}
+
+func ApplyFileEnv(file string, envs []string, opts ...*CheckOpts) (string, error) {
+	_, out, err := runFileEnv(true, file, envs, firstOpts(opts))
+	return out, err
+}
+
+func (uc *UsersCheck) inEnvironment(env string) bool {
+	return len(uc.Environments) == 0 || containsString(uc.Environments, env)
+}
+
+// defaultChecks are the checks run when no environment is selected.
+func (ucff *userChecksFromFile) defaultChecks() []*UsersCheck {
+	checks := []*UsersCheck{}
+	for _, uc := range ucff.Checks {
+		if len(uc.Environments) == 0 {
+			checks = append(checks, uc)
+		}
+	}
+	return checks
+}
+
+func (ucff *userChecksFromFile) validateEnvironments() error {
+	for name, env := range ucff.Environments {
+		if env == nil {
+			return fmt.Errorf("Error in environment %s: empty definition", name)
+		}
+	}
+	for _, uc := range ucff.Checks {
+		for _, name := range uc.Environments {
+			if ucff.Environments[name] == nil {
+				return fmt.Errorf("Error in check %s: unknown environment %s", uc.Prefix, name)
+			}
+		}
+	}
+	return nil
+}
+
+func (ucff *userChecksFromFile) environmentNames(envs []string) ([]string, error) {
+	if err := ucff.validateEnvironments(); err != nil {
+		return nil, err
+	}
+	if len(ucff.Environments) == 0 {
+		return nil, fmt.Errorf("Error selecting environments: no environments defined")
+	}
+	if len(envs) == 0 || (len(envs) == 1 && envs[0] == AllEnvironments) {
+		return sortedKeys(ucff.Environments), nil
+	}
+	names := []string{}
+	for _, name := range envs {
+		if ucff.Environments[name] == nil {
+			return nil, fmt.Errorf("Error selecting environments: unknown environment %s", name)
+		}
+		if !containsString(names, name) {
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+func (ucff *userChecksFromFile) environment(name string, fileOpts *CheckOpts) (*environmentTarget, error) {
+	env := ucff.Environments[name]
+	target := &environmentTarget{name: name, checks: []*UsersCheck{}, nexusHost: ucff.NexusHost, nexusUser: ucff.NexusUser, nexusPass: ucff.NexusPass}
+	if env.NexusHost != "" {
+		target.nexusHost = env.NexusHost
+	}
+	if env.NexusUser != "" {
+		target.nexusUser = env.NexusUser
+	}
+	if env.NexusPass != "" {
+		target.nexusPass = env.NexusPass
+	}
+	for _, uc := range ucff.Checks {
+		if uc.inEnvironment(name) {
+			target.checks = append(target.checks, uc)
+		}
+	}
+	for _, ec := range env.Checks {
+		if ec == nil {
+			continue
+		}
+		// The check replaces every file entry of the same check
+		checks := []*UsersCheck{}
+		replaced := false
+		for _, uc := range target.checks {
+			if uc.Prefix != ec.Prefix || uc.OnlySubUsers != ec.OnlySubUsers {
+				checks = append(checks, uc)
+			} else if !replaced {
+				checks = append(checks, ec)
+				replaced = true
+			}
+		}
+		if !replaced {
+			checks = append(checks, ec)
+		}
+		target.checks = checks
+	}
+	opts, err := overrideOpts(fileOpts, env.Opts)
+	if err != nil {
+		return nil, fmt.Errorf("Error in environment %s: opts: %s", name, err.Error())
+	}
+	target.opts = opts
+	return target, nil
+}
+
+// overrideOpts returns the file opts with the settings of raw overriding them.
+func overrideOpts(opts *CheckOpts, raw json.RawMessage) (*CheckOpts, error) {
+	if len(raw) == 0 || string(raw) == "null" {
+		return opts, nil
+	}
+	byteValue, err := json.Marshal(opts)
+	if err != nil {
+		return nil, err
+	}
+	settings := map[string]json.RawMessage{}
+	if err = json.Unmarshal(byteValue, &settings); err != nil {
+		return nil, err
+	}
+	overrides := map[string]json.RawMessage{}
+	if err = json.Unmarshal(raw, &overrides); err != nil {
+		return nil, err
+	}
+	for key, value := range overrides {
+		settings[key] = value
+	}
+	if byteValue, err = json.Marshal(settings); err != nil {
+		return nil, err
+	}
+	var opt *CheckOpts
+	if err = json.Unmarshal(byteValue, &opt); err != nil {
+		return nil, err
+	}
+	opt.Roles, opt.Exemptions = opts.Roles, opts.Exemptions
+	return opt, nil
+}
+
+func loadEnvironments(file string, envs []string) ([]*environmentTarget, *CheckOpts, error) {
+	ucff, err := loadConfig(file)
+	if err != nil {
+		return nil, nil, err
+	}
+	names, err := ucff.environmentNames(envs)
+	if err != nil {
+		return nil, nil, err
+	}
+	fileOpts := ucff.fileOpts()
+	targets := []*environmentTarget{}
+	for _, name := range names {
+		target, err := ucff.environment(name, fileOpts)
+		if err != nil {
+			return nil, nil, err
+		}
+		targets = append(targets, target)
+	}
+	return targets, fileOpts, nil
+}
+
+// runFileEnv runs the selected environments one after another and combines
+// their reports, labelling each check with its environment.
+func runFileEnv(apply bool, file string, envs []string, opts *CheckOpts) (*Report, string, error) {
+	report := newReport(apply)
+	targets, fileOpts, err := loadEnvironments(file, envs)
+	if err != nil {
+		report.Error = err.Error()
+		return report, err.Error(), err
+	}
+	outs := []string{}
+	errs := []error{}
+	// Exemptions are unused when no environment used them
+	unused := map[*Exemption]int{}
+	runs := 0
+	for _, target := range targets {
+		opt := layerOpts(target.opts, opts)
+		// The combined report is rendered at the end
+		opt.Template, opt.TemplateFile = "", ""
+		if output := opt.output(); output == OutputMarkdown || output == OutputHTML {
+			opt.Output = OutputText
+		}
+		if opt.AuditActor == "" {
+			opt.AuditActor = target.nexusUser
+		}
+		opt.environment = target.name
+		// The combined report is observed at the end
+		opt.Metrics, opt.MetricsFile = nil, ""
+		var envReport *Report
+		var out string
+		nxconn, err := getNexusConn(target.nexusHost, target.nexusUser, target.nexusPass)
+		if err == nil {
+			envReport, out, err = runNexusConn(apply, target.checks, nxconn, opt)
+			nxconn.Close()
+		} else {
+			out = err.Error()
+		}
+		if envReport != nil {
+			report.merge(envReport, target.name)
+			for _, e := range envReport.UnusedExemptions {
+				unused[e]++
+			}
+			runs++
+		}
+		outs = append(outs, fmt.Sprintf("%s environment:\n\n%s\n", target.name, out))
+		if err != nil {
+			errs = append(errs, fmt.Errorf("Error in environment %s: %w", target.name, err))
+			if errors.Is(err, ErrAborted) {
+				break
+			}
+		}
+	}
+	for _, e := range fileOpts.Exemptions {
+		if runs != 0 && unused[e] == runs {
+			report.UnusedExemptions = append(report.UnusedExemptions, e)
+		}
+	}
+	if exemptionsOut := formatExemptions(report.ExpiredExemptions, report.UnusedExemptions); exemptionsOut != "" {
+		outs = append(outs, exemptionsOut)
+	}
+	err = errors.Join(errs...)
+	if err != nil {
+		report.Error = err.Error()
+	}
+	opt := layerOpts(fileOpts, opts)
+	opt.report = report
+	opt.observeReport()
+	return report, opt.render(report, strings.Join(outs, "\n")), err
+}
+
+// merge adds the checks, conflicts and expired exemptions of the report of an
+// environment.
+func (r *Report) merge(other *Report, env string) {
+	for _, cr := range other.Checks {
+		cr.Environment = env
+		r.Checks = append(r.Checks, cr)
+	}
+	r.Conflicts = append(r.Conflicts, other.Conflicts...)
+	for _, e := range other.ExpiredExemptions {
+		if !containsExemption(r.ExpiredExemptions, e) {
+			r.ExpiredExemptions = append(r.ExpiredExemptions, e)
+		}
+	}
+}
+
+func containsExemption(l []*Exemption, e *Exemption) bool {
+	for _, x := range l {
+		if x == e {
+			return true
+		}
+	}
+	return false
+}
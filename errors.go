@@ -0,0 +1,73 @@
+package nxusercheck
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ApplyError is a change that failed to apply to a user. With continueOnError
+// the errors of a run are joined with errors.Join, use errors.As to get them.
+type ApplyError struct {
+	User   string
+	Op     string
+	Prefix string
+	Key    string
+	Err    error
+}
+
+func (e *ApplyError) Error() string {
+	if e.Op == AuditCreate {
+		return fmt.Sprintf("Error creating user %s: %s", e.User, e.Err.Error())
+	}
+	if e.Op == AuditDeleteUser {
+		return fmt.Sprintf("Error deleting user %s: %s", e.User, e.Err.Error())
+	}
+	target := []string{e.Op}
+	for _, s := range []string{e.Prefix, e.Key} {
+		if s != "" {
+			target = append(target, s)
+		}
+	}
+	return fmt.Sprintf("Error applying %s to %s: %s", strings.Join(target, " "), e.User, e.Err.Error())
+}
+
+func (e *ApplyError) Unwrap() error {
+	return e.Err
+}
+
+// ApplyErrors returns the apply errors contained in err.
+func ApplyErrors(err error) []*ApplyError {
+	if ae, ok := err.(*ApplyError); ok {
+		return []*ApplyError{ae}
+	}
+	res := []*ApplyError{}
+	switch e := err.(type) {
+	case interface{ Unwrap() []error }:
+		for _, err := range e.Unwrap() {
+			res = append(res, ApplyErrors(err)...)
+		}
+	case interface{ Unwrap() error }:
+		res = append(res, ApplyErrors(e.Unwrap())...)
+	}
+	return res
+}
+
+func (opts *CheckOpts) continueOnError() bool {
+	return boolOpt(opts.fileOpts().ContinueOnError, opts.ContinueOnError)
+}
+
+func (r *Report) applySummary() (int, int) {
+	applied, failed := 0, 0
+	for _, cr := range r.Checks {
+		for _, ur := range cr.Users {
+			for _, rec := range ur.Applied {
+				if rec.Outcome == AuditOutcomeOk {
+					applied++
+				} else {
+					failed++
+				}
+			}
+		}
+	}
+	return applied, failed
+}
@@ -9,40 +9,17 @@ import (
 
 func main() {
 	checks := []*nuc.UsersCheck{
-		{
-			Prefix:    "test.myuser",
-			Templates: []string{"test.mytemplate"},
-			Permissions: &nuc.Permissions{
-				ByPrefix: nuc.P{
-					"test.mypath1": {
-						"@task.push":   true,
-						"@task.pull":   true,
-						"@user.list":   true,
-						"@user.delete": false,
-					},
-				},
-				OnPrefixes: nuc.P{
-					"@user.list": {
-						"test.mypath2": true,
-						"test.mypath3": true,
-					},
-				},
-			},
-			Tags: &nuc.Tags{
-				ByPrefix: nuc.T{
-					"test.mypath1": {
-						"tag1": []interface{}{"value1", "value2"},
-						"tag2": 123,
-					},
-				},
-				OnPrefixes: nuc.T{
-					"tagA": {
-						"test.mypath2": map[string]interface{}{"a": "b"},
-						"test.mypath3": "value",
-					},
-				},
-			},
-		},
+		nuc.NewCheck("test.myuser").
+			Templates("test.mytemplate").
+			Grant("test.mypath1", "@task.push", "@task.pull", "@user.list").
+			Deny("test.mypath1", "@user.delete").
+			Grant("test.mypath2", "@user.list").
+			Grant("test.mypath3", "@user.list").
+			Tag("test.mypath1", "tag1", []interface{}{"value1", "value2"}).
+			Tag("test.mypath1", "tag2", 123).
+			Tag("test.mypath2", "tagA", map[string]interface{}{"a": "b"}).
+			Tag("test.mypath3", "tagA", "value").
+			MustBuild(),
 	}
 
 	apply := false
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"time"
+
+	nuc "github.com/nayarsystems/nxusercheck"
+)
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Printf("Usage: %s config.json [apply|check] [environment]\n", os.Args[0])
+		os.Exit(1)
+	}
+
+	rec := nuc.NewReconciler(os.Args[1])
+	rec.Interval = time.Minute
+	rec.AutoApply = len(os.Args) >= 3 && os.Args[2] == "apply"
+	if len(os.Args) >= 4 {
+		rec.Environment = os.Args[3]
+	}
+	rec.Listen = "localhost:9717"
+	rec.Metrics = nuc.NewMetrics()
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+	if err := rec.Run(ctx); err != nil && err != context.Canceled {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+}
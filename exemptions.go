@@ -0,0 +1,207 @@
+package nxusercheck
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"time"
+)
+
+// Exemption suppresses the findings of a user (or users matching a glob
+// pattern) for a kind, prefix and key. Empty kind, prefix or key match any.
+// Once expired the findings are reported again.
+type Exemption struct {
+	User    string `json:"user"`
+	Kind    string `json:"kind,omitempty"`
+	Prefix  string `json:"prefix,omitempty"`
+	Key     string `json:"key,omitempty"`
+	Reason  string `json:"reason"`
+	Owner   string `json:"owner"`
+	Expires string `json:"expires,omitempty"`
+}
+
+var exemptionDateLayouts = []string{time.RFC3339, "2006-01-02"}
+
+func (e *Exemption) validate() error {
+	if e.User == "" {
+		return fmt.Errorf("Error in exemption %s: missing user", e)
+	}
+	if e.Reason == "" {
+		return fmt.Errorf("Error in exemption %s: missing reason", e)
+	}
+	if e.Owner == "" {
+		return fmt.Errorf("Error in exemption %s: missing owner", e)
+	}
+	if e.Kind != "" && e.Kind != KindTemplates && e.Kind != KindTags && e.Kind != KindPermissions && e.Kind != KindRules {
+		return fmt.Errorf("Error in exemption %s: invalid kind %s", e, e.Kind)
+	}
+	if _, err := e.expiry(); err != nil {
+		return fmt.Errorf("Error in exemption %s: invalid expires %s", e, e.Expires)
+	}
+	return nil
+}
+
+func (e *Exemption) expiry() (time.Time, error) {
+	if e.Expires == "" {
+		return time.Time{}, nil
+	}
+	var err error
+	for _, layout := range exemptionDateLayouts {
+		var t time.Time
+		if t, err = time.Parse(layout, e.Expires); err == nil {
+			if layout == "2006-01-02" {
+				t = t.AddDate(0, 0, 1)
+			}
+			return t, nil
+		}
+	}
+	return time.Time{}, err
+}
+
+func (e *Exemption) expired(now time.Time) bool {
+	t, err := e.expiry()
+	return err == nil && !t.IsZero() && !now.Before(t)
+}
+
+func (e *Exemption) matches(user string, kind string, prefix string, key string) bool {
+	if e.User != user {
+		if ok, _ := path.Match(e.User, user); !ok {
+			return false
+		}
+	}
+	return (e.Kind == "" || e.Kind == kind) && (e.Prefix == "" || e.Prefix == prefix) && (e.Key == "" || e.Key == key)
+}
+
+func (e *Exemption) String() string {
+	parts := []string{e.User}
+	for _, p := range []string{e.Kind, e.Prefix, e.Key} {
+		if p != "" {
+			parts = append(parts, p)
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+func validateExemptions(exemptions []*Exemption) error {
+	for _, e := range exemptions {
+		if err := e.validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// exemption returns the active exemption matching a finding, marking it as
+// used. Matching expired exemptions are ignored.
+func (opts *CheckOpts) exemption(user string, kind string, prefix string, key string) *Exemption {
+	now := time.Now()
+	for _, e := range opts.Exemptions {
+		if !e.expired(now) && e.matches(user, kind, prefix, key) {
+			if opts.exemptionsUsed != nil {
+				opts.exemptionsUsed[e] = true
+			}
+			return e
+		}
+	}
+	return nil
+}
+
+func (opts *CheckOpts) exemptTags(ur *UserReport, kind string, wrong, missing, extra T) (T, T, T) {
+	if len(opts.Exemptions) == 0 {
+		return wrong, missing, extra
+	}
+	fwrong, fmissing, fextra := T{}, T{}, T{}
+	for prefix, tagval := range missing {
+		for tag, value := range tagval {
+			if e := opts.exemption(ur.User, kind, prefix, tag); e != nil {
+				category := CategoryMissing
+				var has interface{}
+				if hvalue, ok := wrong[prefix][tag]; ok {
+					category, has = CategoryWrong, hvalue
+				}
+				ur.addExempted(&Finding{Kind: kind, Category: category, Prefix: prefix, Key: tag, Has: has, Wants: value}, e)
+				continue
+			}
+			addPrefTagVal(fmissing, prefix, tag, value)
+			if hvalue, ok := wrong[prefix][tag]; ok {
+				addPrefTagVal(fwrong, prefix, tag, hvalue)
+			}
+		}
+	}
+	for prefix, tagval := range extra {
+		for tag, value := range tagval {
+			if e := opts.exemption(ur.User, kind, prefix, tag); e != nil {
+				ur.addExempted(&Finding{Kind: kind, Category: CategoryExtra, Prefix: prefix, Key: tag, Has: value}, e)
+				continue
+			}
+			addPrefTagVal(fextra, prefix, tag, value)
+		}
+	}
+	return fwrong, fmissing, fextra
+}
+
+func (opts *CheckOpts) exemptTemplates(ur *UserReport, wrongOrder bool, missing, extra []string) (bool, []string, []string) {
+	if len(opts.Exemptions) == 0 {
+		return wrongOrder, missing, extra
+	}
+	if wrongOrder {
+		if e := opts.exemption(ur.User, KindTemplates, "", ""); e != nil {
+			ur.addExempted(&Finding{Kind: KindTemplates, Category: CategoryWrong}, e)
+			wrongOrder = false
+		}
+	}
+	filter := func(category string, tpls []string) []string {
+		res := []string{}
+		for _, tpl := range tpls {
+			if e := opts.exemption(ur.User, KindTemplates, "", tpl); e != nil {
+				ur.addExempted(&Finding{Kind: KindTemplates, Category: category, Key: tpl}, e)
+			} else {
+				res = append(res, tpl)
+			}
+		}
+		return res
+	}
+	return wrongOrder, filter(CategoryMissing, missing), filter(CategoryExtra, extra)
+}
+
+func (ur *UserReport) addExempted(f *Finding, e *Exemption) {
+	f.Exemption = e
+	ur.Exempted = append(ur.Exempted, f)
+}
+
+func (opts *CheckOpts) reportExemptions() string {
+	if opts.exemptionsUsed == nil {
+		return ""
+	}
+	now := time.Now()
+	for _, e := range opts.Exemptions {
+		if e.expired(now) {
+			opts.report.ExpiredExemptions = append(opts.report.ExpiredExemptions, e)
+		} else if !opts.exemptionsUsed[e] {
+			opts.report.UnusedExemptions = append(opts.report.UnusedExemptions, e)
+		}
+	}
+	// Environments are reported together by runFileEnv
+	if opts.environment != "" {
+		return ""
+	}
+	return formatExemptions(opts.report.ExpiredExemptions, opts.report.UnusedExemptions)
+}
+
+func formatExemptions(expiredExemptions []*Exemption, unusedExemptions []*Exemption) string {
+	expired, unused := []string{}, []string{}
+	for _, e := range expiredExemptions {
+		expired = append(expired, fmt.Sprintf("\t* %s (owner %s): %s [expired %s]", e, e.Owner, e.Reason, e.Expires))
+	}
+	for _, e := range unusedExemptions {
+		unused = append(unused, fmt.Sprintf("\t* %s (owner %s): %s", e, e.Owner, e.Reason))
+	}
+	ls := []string{}
+	if len(expired) != 0 {
+		ls = append(ls, fmt.Sprintf("EXPIRED EXEMPTIONS:\n\n%s\n", strings.Join(expired, "\n")))
+	}
+	if len(unused) != 0 {
+		ls = append(ls, fmt.Sprintf("UNUSED EXEMPTIONS:\n\n%s\n", strings.Join(unused, "\n")))
+	}
+	return strings.Join(ls, "\n")
+}
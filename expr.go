@@ -0,0 +1,678 @@
+package nxusercheck
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/jaracil/ei"
+)
+
+// Expressions are evaluated against JSON values (nil, bool, float64, string,
+// []interface{} and map[string]interface{}). They support literals (numbers,
+// 'strings', "strings", true, false, null), variables, member access (a.b),
+// indexing (a['b'], a[0], negative indexes count from the end), function
+// calls, the operators ! - * / % + < <= > >= == != in && || and the
+// conditional a ? b : c. Accessing a missing member or index gives null.
+
+// exprVars are the variables of rule expressions, see exprEnv.
+var exprVars = []string{"user", "prefix", "templates", "tags"}
+
+type exprNode interface {
+	eval(env map[string]interface{}) (interface{}, error)
+}
+
+type exprLiteral struct{ value interface{} }
+
+type exprIdent struct{ name string }
+
+type exprUnary struct {
+	op string
+	x  exprNode
+}
+
+type exprBinary struct {
+	op   string
+	l, r exprNode
+}
+
+type exprMember struct {
+	x    exprNode
+	name string
+}
+
+type exprIndex struct {
+	x, index exprNode
+}
+
+type exprCall struct {
+	name string
+	args []exprNode
+}
+
+type exprCond struct {
+	cond, a, b exprNode
+}
+
+type exprToken struct {
+	kind  string // num, str, ident, op or eof
+	text  string
+	value interface{}
+	pos   int
+}
+
+var exprOps = []string{"==", "!=", "<=", ">=", "&&", "||", "(", ")", "[", "]", ".", ",", "!", "<", ">", "+", "-", "*", "/", "%", "?", ":"}
+
+func lexExpr(src string) ([]*exprToken, error) {
+	toks := []*exprToken{}
+	i := 0
+	digits := func() {
+		for i < len(src) && src[i] >= '0' && src[i] <= '9' {
+			i++
+		}
+	}
+	for i < len(src) {
+		c, size := utf8.DecodeRuneInString(src[i:])
+		switch {
+		case unicode.IsSpace(c):
+			i += size
+		case c >= '0' && c <= '9':
+			start := i
+			digits()
+			if i < len(src) && src[i] == '.' {
+				i++
+				digits()
+			}
+			if i < len(src) && (src[i] == 'e' || src[i] == 'E') {
+				i++
+				if i < len(src) && (src[i] == '+' || src[i] == '-') {
+					i++
+				}
+				digits()
+			}
+			n, err := strconv.ParseFloat(src[start:i], 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid number %s at %d", src[start:i], start)
+			}
+			toks = append(toks, &exprToken{kind: "num", text: src[start:i], value: n, pos: start})
+		case c == '\'' || c == '"':
+			start := i
+			sb := strings.Builder{}
+			i++
+			for ; i < len(src) && rune(src[i]) != c; i++ {
+				if src[i] == '\\' && i+1 < len(src) {
+					i++
+					switch src[i] {
+					case 'n':
+						sb.WriteByte('\n')
+					case 't':
+						sb.WriteByte('\t')
+					default:
+						sb.WriteByte(src[i])
+					}
+					continue
+				}
+				sb.WriteByte(src[i])
+			}
+			if i >= len(src) {
+				return nil, fmt.Errorf("unterminated string at %d", start)
+			}
+			i++
+			toks = append(toks, &exprToken{kind: "str", text: src[start:i], value: sb.String(), pos: start})
+		case c == '_' || c == '@' || unicode.IsLetter(c):
+			start := i
+			for i < len(src) {
+				c, size := utf8.DecodeRuneInString(src[i:])
+				if c != '_' && c != '@' && !unicode.IsLetter(c) && !unicode.IsDigit(c) {
+					break
+				}
+				i += size
+			}
+			toks = append(toks, &exprToken{kind: "ident", text: src[start:i], pos: start})
+		default:
+			op := ""
+			for _, o := range exprOps {
+				if strings.HasPrefix(src[i:], o) {
+					op = o
+					break
+				}
+			}
+			if op == "" {
+				return nil, fmt.Errorf("unexpected %q at %d", c, i)
+			}
+			toks = append(toks, &exprToken{kind: "op", text: op, pos: i})
+			i += len(op)
+		}
+	}
+	return append(toks, &exprToken{kind: "eof", pos: len(src)}), nil
+}
+
+type exprParser struct {
+	toks []*exprToken
+	pos  int
+}
+
+// parseExpr compiles an expression.
+func parseExpr(src string) (exprNode, error) {
+	toks, err := lexExpr(src)
+	if err != nil {
+		return nil, err
+	}
+	p := &exprParser{toks: toks}
+	node, err := p.parseCond()
+	if err != nil {
+		return nil, err
+	}
+	if tok := p.peek(); tok.kind != "eof" {
+		return nil, fmt.Errorf("unexpected %s at %d", tok.text, tok.pos)
+	}
+	return node, nil
+}
+
+func (p *exprParser) peek() *exprToken {
+	return p.toks[p.pos]
+}
+
+func (p *exprParser) next() *exprToken {
+	tok := p.toks[p.pos]
+	if tok.kind != "eof" {
+		p.pos++
+	}
+	return tok
+}
+
+func (p *exprParser) accept(op string) bool {
+	if tok := p.peek(); (tok.kind == "op" || tok.kind == "ident") && tok.text == op {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *exprParser) expect(op string) error {
+	if !p.accept(op) {
+		tok := p.peek()
+		if tok.kind == "eof" {
+			return fmt.Errorf("expected %s at end of expression", op)
+		}
+		return fmt.Errorf("expected %s at %d, found %s", op, tok.pos, tok.text)
+	}
+	return nil
+}
+
+// exprLevels are the binary operators by precedence, lowest first.
+var exprLevels = [][]string{
+	{"||"},
+	{"&&"},
+	{"==", "!="},
+	{"<", "<=", ">", ">=", "in"},
+	{"+", "-"},
+	{"*", "/", "%"},
+}
+
+// exprComparisons can't be chained, a < b < c is an error.
+var exprComparisons = []string{"==", "!=", "<", "<=", ">", ">=", "in"}
+
+func (p *exprParser) parseCond() (exprNode, error) {
+	cond, err := p.parseBinary(0)
+	if err != nil || !p.accept("?") {
+		return cond, err
+	}
+	a, err := p.parseCond()
+	if err != nil {
+		return nil, err
+	}
+	if err = p.expect(":"); err != nil {
+		return nil, err
+	}
+	b, err := p.parseCond()
+	if err != nil {
+		return nil, err
+	}
+	return &exprCond{cond: cond, a: a, b: b}, nil
+}
+
+func (p *exprParser) parseBinary(level int) (exprNode, error) {
+	if level == len(exprLevels) {
+		return p.parseUnary()
+	}
+	l, err := p.parseBinary(level + 1)
+	if err != nil {
+		return nil, err
+	}
+	for n := 0; ; n++ {
+		op := ""
+		for _, o := range exprLevels[level] {
+			if p.accept(o) {
+				op = o
+				break
+			}
+		}
+		if op == "" {
+			return l, nil
+		}
+		if n > 0 && containsString(exprComparisons, op) {
+			return nil, fmt.Errorf("chained comparison %s at %d", op, p.toks[p.pos-1].pos)
+		}
+		r, err := p.parseBinary(level + 1)
+		if err != nil {
+			return nil, err
+		}
+		l = &exprBinary{op: op, l: l, r: r}
+	}
+}
+
+func (p *exprParser) parseUnary() (exprNode, error) {
+	for _, op := range []string{"!", "-"} {
+		if p.accept(op) {
+			x, err := p.parseUnary()
+			if err != nil {
+				return nil, err
+			}
+			return &exprUnary{op: op, x: x}, nil
+		}
+	}
+	return p.parsePostfix()
+}
+
+func (p *exprParser) parsePostfix() (exprNode, error) {
+	x, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		switch {
+		case p.accept("."):
+			tok := p.next()
+			if tok.kind != "ident" {
+				return nil, fmt.Errorf("expected member name at %d", tok.pos)
+			}
+			x = &exprMember{x: x, name: tok.text}
+		case p.accept("["):
+			index, err := p.parseCond()
+			if err != nil {
+				return nil, err
+			}
+			if err = p.expect("]"); err != nil {
+				return nil, err
+			}
+			x = &exprIndex{x: x, index: index}
+		default:
+			return x, nil
+		}
+	}
+}
+
+func (p *exprParser) parsePrimary() (exprNode, error) {
+	tok := p.next()
+	switch tok.kind {
+	case "num", "str":
+		return &exprLiteral{value: tok.value}, nil
+	case "ident":
+		switch tok.text {
+		case "true":
+			return &exprLiteral{value: true}, nil
+		case "false":
+			return &exprLiteral{value: false}, nil
+		case "null":
+			return &exprLiteral{value: nil}, nil
+		}
+		if !p.accept("(") {
+			if !containsString(exprVars, tok.text) {
+				return nil, fmt.Errorf("unknown variable %s at %d", tok.text, tok.pos)
+			}
+			return &exprIdent{name: tok.text}, nil
+		}
+		if _, ok := exprFuncs[tok.text]; !ok {
+			return nil, fmt.Errorf("unknown function %s at %d", tok.text, tok.pos)
+		}
+		call := &exprCall{name: tok.text, args: []exprNode{}}
+		for !p.accept(")") {
+			if len(call.args) != 0 {
+				if err := p.expect(","); err != nil {
+					return nil, err
+				}
+			}
+			arg, err := p.parseCond()
+			if err != nil {
+				return nil, err
+			}
+			call.args = append(call.args, arg)
+		}
+		if f := exprFuncs[tok.text]; len(call.args) != f.args {
+			return nil, fmt.Errorf("%s takes %d arguments, got %d at %d", tok.text, f.args, len(call.args), tok.pos)
+		}
+		return call, nil
+	case "op":
+		if tok.text == "(" {
+			x, err := p.parseCond()
+			if err != nil {
+				return nil, err
+			}
+			return x, p.expect(")")
+		}
+	case "eof":
+		return nil, fmt.Errorf("unexpected end of expression")
+	}
+	return nil, fmt.Errorf("unexpected %s at %d", tok.text, tok.pos)
+}
+
+func (n *exprLiteral) eval(env map[string]interface{}) (interface{}, error) {
+	return n.value, nil
+}
+
+func (n *exprIdent) eval(env map[string]interface{}) (interface{}, error) {
+	v, ok := env[n.name]
+	if !ok {
+		return nil, fmt.Errorf("unknown variable %s", n.name)
+	}
+	return v, nil
+}
+
+func (n *exprUnary) eval(env map[string]interface{}) (interface{}, error) {
+	x, err := n.x.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	if n.op == "!" {
+		return !exprTruthy(x), nil
+	}
+	f, ok := x.(float64)
+	if !ok {
+		return nil, fmt.Errorf("invalid operand for -: %s", jsonValue(x))
+	}
+	return -f, nil
+}
+
+func (n *exprBinary) eval(env map[string]interface{}) (interface{}, error) {
+	l, err := n.l.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	switch n.op {
+	case "&&":
+		if !exprTruthy(l) {
+			return false, nil
+		}
+	case "||":
+		if exprTruthy(l) {
+			return true, nil
+		}
+	}
+	r, err := n.r.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	switch n.op {
+	case "&&", "||":
+		return exprTruthy(r), nil
+	case "==":
+		return reflect.DeepEqual(l, r), nil
+	case "!=":
+		return !reflect.DeepEqual(l, r), nil
+	case "in":
+		switch rv := r.(type) {
+		case nil:
+			return false, nil
+		case string:
+			s, ok := l.(string)
+			return ok && strings.Contains(rv, s), nil
+		case []interface{}:
+			for _, v := range rv {
+				if reflect.DeepEqual(v, l) {
+					return true, nil
+				}
+			}
+			return false, nil
+		case map[string]interface{}:
+			s, ok := l.(string)
+			if ok {
+				_, ok = rv[s]
+			}
+			return ok, nil
+		}
+	case "+":
+		switch lv := l.(type) {
+		case string:
+			if rv, ok := r.(string); ok {
+				return lv + rv, nil
+			}
+		case []interface{}:
+			if rv, ok := r.([]interface{}); ok {
+				return append(append([]interface{}{}, lv...), rv...), nil
+			}
+		}
+	}
+	if ls, ok := l.(string); ok {
+		if rs, ok := r.(string); ok {
+			switch n.op {
+			case "<":
+				return ls < rs, nil
+			case "<=":
+				return ls <= rs, nil
+			case ">":
+				return ls > rs, nil
+			case ">=":
+				return ls >= rs, nil
+			}
+		}
+	}
+	lf, lok := l.(float64)
+	rf, rok := r.(float64)
+	if !lok || !rok {
+		return nil, fmt.Errorf("invalid operands for %s: %s and %s", n.op, jsonValue(l), jsonValue(r))
+	}
+	switch n.op {
+	case "<":
+		return lf < rf, nil
+	case "<=":
+		return lf <= rf, nil
+	case ">":
+		return lf > rf, nil
+	case ">=":
+		return lf >= rf, nil
+	case "+":
+		return lf + rf, nil
+	case "-":
+		return lf - rf, nil
+	case "*":
+		return lf * rf, nil
+	case "/", "%":
+		if rf == 0 {
+			return nil, fmt.Errorf("division by zero")
+		}
+		if n.op == "%" {
+			return math.Mod(lf, rf), nil
+		}
+		return lf / rf, nil
+	}
+	return nil, fmt.Errorf("invalid operands for %s: %s and %s", n.op, jsonValue(l), jsonValue(r))
+}
+
+func (n *exprMember) eval(env map[string]interface{}) (interface{}, error) {
+	x, err := n.x.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	return exprLookup(x, n.name)
+}
+
+func (n *exprIndex) eval(env map[string]interface{}) (interface{}, error) {
+	x, err := n.x.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	index, err := n.index.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	return exprLookup(x, index)
+}
+
+func exprLookup(x interface{}, index interface{}) (interface{}, error) {
+	switch xv := x.(type) {
+	case nil:
+		return nil, nil
+	case map[string]interface{}:
+		if key, ok := index.(string); ok {
+			return xv[key], nil
+		}
+	case []interface{}:
+		if f, ok := index.(float64); ok && f == math.Trunc(f) {
+			i := int(f)
+			if i < 0 {
+				i += len(xv)
+			}
+			if i < 0 || i >= len(xv) {
+				return nil, nil
+			}
+			return xv[i], nil
+		}
+	}
+	return nil, fmt.Errorf("can't index %s with %s", jsonValue(x), jsonValue(index))
+}
+
+func (n *exprCond) eval(env map[string]interface{}) (interface{}, error) {
+	cond, err := n.cond.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	if exprTruthy(cond) {
+		return n.a.eval(env)
+	}
+	return n.b.eval(env)
+}
+
+func (n *exprCall) eval(env map[string]interface{}) (interface{}, error) {
+	args := []interface{}{}
+	for _, arg := range n.args {
+		v, err := arg.eval(env)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, v)
+	}
+	f := exprFuncs[n.name]
+	if len(args) != f.args {
+		return nil, fmt.Errorf("%s takes %d arguments, got %d", n.name, f.args, len(args))
+	}
+	v, err := f.call(args)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", n.name, err.Error())
+	}
+	return v, nil
+}
+
+func exprTruthy(v interface{}) bool {
+	switch vv := v.(type) {
+	case nil:
+		return false
+	case bool:
+		return vv
+	case float64:
+		return vv != 0
+	case string:
+		return vv != ""
+	case []interface{}:
+		return len(vv) != 0
+	case map[string]interface{}:
+		return len(vv) != 0
+	}
+	return true
+}
+
+type exprFunc struct {
+	args int
+	call func(args []interface{}) (interface{}, error)
+}
+
+func exprStrings(args []interface{}) ([]string, error) {
+	ss := []string{}
+	for _, arg := range args {
+		s, ok := arg.(string)
+		if !ok {
+			return nil, fmt.Errorf("expected string, got %s", jsonValue(arg))
+		}
+		ss = append(ss, s)
+	}
+	return ss, nil
+}
+
+func exprStringsFunc(args int, f func(ss []string) interface{}) *exprFunc {
+	return &exprFunc{args: args, call: func(args []interface{}) (interface{}, error) {
+		ss, err := exprStrings(args)
+		if err != nil {
+			return nil, err
+		}
+		return f(ss), nil
+	}}
+}
+
+var exprFuncs = map[string]*exprFunc{
+	"len": {args: 1, call: func(args []interface{}) (interface{}, error) {
+		switch v := args[0].(type) {
+		case nil:
+			return float64(0), nil
+		case string:
+			return float64(len(v)), nil
+		case []interface{}:
+			return float64(len(v)), nil
+		case map[string]interface{}:
+			return float64(len(v)), nil
+		}
+		return nil, fmt.Errorf("invalid argument %s", jsonValue(args[0]))
+	}},
+	"first": {args: 1, call: func(args []interface{}) (interface{}, error) {
+		return exprLookup(args[0], float64(0))
+	}},
+	"last": {args: 1, call: func(args []interface{}) (interface{}, error) {
+		return exprLookup(args[0], float64(-1))
+	}},
+	"keys": {args: 1, call: func(args []interface{}) (interface{}, error) {
+		m, ok := args[0].(map[string]interface{})
+		if !ok && args[0] != nil {
+			return nil, fmt.Errorf("invalid argument %s", jsonValue(args[0]))
+		}
+		keys := []interface{}{}
+		for _, k := range sortedKeys(m) {
+			keys = append(keys, k)
+		}
+		return keys, nil
+	}},
+	"split": exprStringsFunc(2, func(ss []string) interface{} {
+		parts := []interface{}{}
+		for _, s := range strings.Split(ss[0], ss[1]) {
+			parts = append(parts, s)
+		}
+		return parts
+	}),
+	"lower":      exprStringsFunc(1, func(ss []string) interface{} { return strings.ToLower(ss[0]) }),
+	"upper":      exprStringsFunc(1, func(ss []string) interface{} { return strings.ToUpper(ss[0]) }),
+	"startsWith": exprStringsFunc(2, func(ss []string) interface{} { return strings.HasPrefix(ss[0], ss[1]) }),
+	"endsWith":   exprStringsFunc(2, func(ss []string) interface{} { return strings.HasSuffix(ss[0], ss[1]) }),
+	"matches": {args: 2, call: func(args []interface{}) (interface{}, error) {
+		ss, err := exprStrings(args)
+		if err != nil {
+			return nil, err
+		}
+		re, err := regexp.Compile(ss[1])
+		if err != nil {
+			return nil, err
+		}
+		return re.MatchString(ss[0]), nil
+	}},
+	"string": {args: 1, call: func(args []interface{}) (interface{}, error) {
+		if s, ok := args[0].(string); ok {
+			return s, nil
+		}
+		return jsonValue(args[0]), nil
+	}},
+	"bool": {args: 1, call: func(args []interface{}) (interface{}, error) {
+		return ei.N(args[0]).BoolZ(), nil
+	}},
+}
@@ -0,0 +1,201 @@
+package nxusercheck
+
+import (
+	"reflect"
+	"testing"
+
+	nx "github.com/nayarsystems/nxgo/nxcore"
+)
+
+var testExprEnv = exprEnv("test", &nx.UserInfo{
+	User:      "test.devices.a1",
+	Templates: []string{"test.base", "test.admin"},
+	Tags: map[string]map[string]interface{}{
+		"devices": {"serial": "a1", "count": 3},
+		"test":    {"@user.delete": false, "name": "Ñandú"},
+	},
+})
+
+func TestExprEval(t *testing.T) {
+	tests := []struct {
+		expr string
+		want interface{}
+	}{
+		// Literals
+		{"1", 1.0},
+		{"1.5", 1.5},
+		{"1e3", 1000.0},
+		{"1e-3", 0.001},
+		{"2.5E+2", 250.0},
+		{"'a'", "a"},
+		{`"a\"b"`, `a"b`},
+		{`'a\nb'`, "a\nb"},
+		{"true", true},
+		{"null", nil},
+		// Precedence and associativity
+		{"1 + 2 * 3", 7.0},
+		{"(1 + 2) * 3", 9.0},
+		{"10 - 4 - 3", 3.0},
+		{"8 / 4 / 2", 1.0},
+		{"7 % 4 * 2", 6.0},
+		{"-2 * 3", -6.0},
+		{"--2", 2.0},
+		{"!true || true", true},
+		{"!(true || true)", false},
+		{"true || false && false", true},
+		{"1 < 2 == 2 < 3", true},
+		{"1 + 1 == 2 && 'a' < 'b'", true},
+		{"1e-3 < 1", true},
+		{"(1 < 2) == true", true},
+		{"true ? 1 : 2", 1.0},
+		{"false ? 1 : true ? 2 : 3", 2.0},
+		{"1 < 2 ? 'a' : 'b'", "a"},
+		// Operators on values
+		{"'a' + 'b'", "ab"},
+		{"'b' in 'abc'", true},
+		{"'x' in null", false},
+		{"'test.admin' in templates", true},
+		{"'devices' in tags", true},
+		{"1 == 1.0", true},
+		// Member access and indexing
+		{"tags.devices.serial", "a1"},
+		{"tags['devices']['count']", 3.0},
+		{"tags.missing.serial", nil},
+		{"templates[0]", "test.base"},
+		{"templates[-1]", "test.admin"},
+		{"templates[5]", nil},
+		{"tags.test.name", "Ñandú"},
+		// Functions
+		{"len(templates)", 2.0},
+		{"len(null)", 0.0},
+		{"first(split(user, '.'))", "test"},
+		{"last(split(user, '.'))", "a1"},
+		{"keys(tags)", []interface{}{"devices", "test"}},
+		{"lower('AbC') + upper('d')", "abcD"},
+		{"startsWith(user, prefix + '.')", true},
+		{"endsWith(user, 'a1')", true},
+		{"matches(user, '^test\\\\.devices\\\\.[a-z][0-9]$')", true},
+		{"string(tags.devices.count)", "3"},
+		{"bool(tags.test['@user.delete'])", false},
+	}
+	for _, test := range tests {
+		node, err := parseExpr(test.expr)
+		if err != nil {
+			t.Errorf("%s: %s", test.expr, err)
+			continue
+		}
+		got, err := node.eval(testExprEnv)
+		if err != nil {
+			t.Errorf("%s: %s", test.expr, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %s, want %s", test.expr, jsonValue(got), jsonValue(test.want))
+		}
+	}
+}
+
+func TestExprParseErrors(t *testing.T) {
+	tests := []struct {
+		expr string
+		err  string
+	}{
+		{"", "unexpected end of expression"},
+		{"1 +", "unexpected end of expression"},
+		{"1 2", "unexpected 2 at 2"},
+		{"1e", "invalid number 1e at 0"},
+		{"1.2.3", "expected member name at 4"},
+		{"templates == ['x']", "unexpected [ at 13"},
+		{"'abc", "unterminated string at 0"},
+		{"1 # 2", `unexpected '#' at 2`},
+		{"Ñ == 1", "unknown variable Ñ at 0"},
+		{"userx", "unknown variable userx at 0"},
+		{"nope(1)", "unknown function nope at 0"},
+		{"len(1, 2)", "len takes 1 arguments, got 2 at 0"},
+		{"len()", "len takes 1 arguments, got 0 at 0"},
+		{"len(1,)", "unexpected ) at 6"},
+		{"len(1", "expected , at end of expression"},
+		{"(1", "expected ) at end of expression"},
+		{"templates[0", "expected ] at end of expression"},
+		{"tags.", "expected member name at 5"},
+		{"true ? 1", "expected : at end of expression"},
+		{"1 < 2 < 3", "chained comparison < at 6"},
+		{"1 == 1 != true", "chained comparison != at 7"},
+		{"'a' in 'b' in 'c'", "chained comparison in at 11"},
+	}
+	for _, test := range tests {
+		_, err := parseExpr(test.expr)
+		if err == nil {
+			t.Errorf("%q: expected error %s", test.expr, test.err)
+		} else if err.Error() != test.err {
+			t.Errorf("%q: got error %s, want %s", test.expr, err, test.err)
+		}
+	}
+}
+
+func TestExprEvalErrors(t *testing.T) {
+	tests := []struct {
+		expr string
+		err  string
+	}{
+		{"1 / 0", "division by zero"},
+		{"1 + 'a'", `invalid operands for +: 1 and "a"`},
+		{"-'a'", `invalid operand for -: "a"`},
+		{"user[0]", `can't index "test.devices.a1" with 0`},
+		{"lower(1)", "lower: expected string, got 1"},
+		{"matches(user, '(')", "matches: error parsing regexp: missing closing ): `(`"},
+	}
+	for _, test := range tests {
+		node, err := parseExpr(test.expr)
+		if err != nil {
+			t.Errorf("%s: %s", test.expr, err)
+			continue
+		}
+		_, err = node.eval(testExprEnv)
+		if err == nil {
+			t.Errorf("%s: expected error %s", test.expr, test.err)
+		} else if err.Error() != test.err {
+			t.Errorf("%s: got error %s, want %s", test.expr, err, test.err)
+		}
+	}
+}
+
+// TestExprRulesReadme checks the expression rules of the README.
+func TestExprRulesReadme(t *testing.T) {
+	rules := []*ExprRule{
+		{Name: "serial", Expr: "tags['devices'].serial == last(split(user, '.'))", Message: "serial must equal the last path segment"},
+		{Name: "no-delete", When: "'test.admin' in templates", Expr: "!bool(tags['test']['@user.delete'])", Message: "admins can't delete users", Severity: SeverityWarning},
+	}
+	tests := []struct {
+		user  *nx.UserInfo
+		fails []string
+	}{
+		{&nx.UserInfo{User: "test.devices.a1", Tags: map[string]map[string]interface{}{"devices": {"serial": "a1"}}}, []string{}},
+		{&nx.UserInfo{User: "test.devices.a1", Tags: map[string]map[string]interface{}{"devices": {"serial": "b2"}}}, []string{"serial"}},
+		{&nx.UserInfo{User: "test.a1", Templates: []string{"test.admin"}, Tags: map[string]map[string]interface{}{"devices": {"serial": "a1"}, "test": {"@user.delete": true}}}, []string{"no-delete"}},
+		{&nx.UserInfo{User: "test.a1", Tags: map[string]map[string]interface{}{"devices": {"serial": "a1"}, "test": {"@user.delete": true}}}, []string{}},
+	}
+	rc := &RuleContext{Check: &UsersCheck{Prefix: "test"}}
+	for _, test := range tests {
+		fails := []string{}
+		for _, er := range rules {
+			rule, err := er.compile()
+			if err != nil {
+				t.Fatalf("%s: %s", er.Name, err)
+			}
+			rfs, err := rule.Check(rc, test.user)
+			if err != nil {
+				t.Errorf("%s on %s: %s", er.Name, test.user.User, err)
+			}
+			if len(rfs) != 0 {
+				fails = append(fails, er.Name)
+				if rfs[0].Message != er.Message || rfs[0].Severity != er.Severity {
+					t.Errorf("%s on %s: wrong finding %s", er.Name, test.user.User, jsonValue(rfs[0]))
+				}
+			}
+		}
+		if !reflect.DeepEqual(fails, test.fails) {
+			t.Errorf("%s: got failing rules %v, want %v", jsonValue(test.user), fails, test.fails)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package nxusercheck
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	nx "github.com/nayarsystems/nxgo/nxcore"
+)
+
+// Handler is an embeddable http API to run checks on demand:
+//
+//	GET|POST /checks/{name}/run  runs the check with the given name (or prefix)
+//	GET      /users/{user}       checks a user against all the matching checks
+//	GET      /report             returns the result of the last run
+//	POST     /apply              applies all checks (or ?check={name})
+//
+// Apply requests are rejected unless Authorize is set and returns nil.
+type Handler struct {
+	Authorize func(r *http.Request) error
+
+	mu     sync.Mutex
+	checks []*UsersCheck
+	nxconn *nx.NexusConn
+	opts   *CheckOpts
+	last   *APIResult
+}
+
+type APIResult struct {
+	Ok     bool    `json:"ok"`
+	Output string  `json:"output"`
+	Error  string  `json:"error,omitempty"`
+	Report *Report `json:"report,omitempty"`
+}
+
+func NewHandler(checks []*UsersCheck, nxconn *nx.NexusConn, opts ...*CheckOpts) *Handler {
+	return &Handler{checks: checks, nxconn: nxconn, opts: firstOpts(opts)}
+}
+
+func NewFileHandler(file string, nxconn *nx.NexusConn, opts ...*CheckOpts) (*Handler, error) {
+	checks, opt, _, _, _, err := getUserChecksFromFile(file)
+	if err != nil {
+		return nil, err
+	}
+	return NewHandler(checks, nxconn, layerOpts(opt, firstOpts(opts))), nil
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.Trim(r.URL.Path, "/")
+	parts := strings.Split(path, "/")
+	switch {
+	case path == "report" && r.Method == http.MethodGet:
+		h.mu.Lock()
+		last := h.last
+		h.mu.Unlock()
+		if last == nil {
+			writeAPIError(w, http.StatusNotFound, "no report yet")
+			return
+		}
+		writeAPIResult(w, last)
+	case path == "apply" && r.Method == http.MethodPost:
+		if h.Authorize == nil {
+			writeAPIError(w, http.StatusForbidden, "apply not allowed")
+			return
+		}
+		if err := h.Authorize(r); err != nil {
+			writeAPIError(w, http.StatusForbidden, err.Error())
+			return
+		}
+		checks := h.checks
+		if name := r.URL.Query().Get("check"); name != "" {
+			if checks = h.findChecks(name); len(checks) == 0 {
+				writeAPIError(w, http.StatusNotFound, fmt.Sprintf("check %s not found", name))
+				return
+			}
+		}
+		writeAPIResult(w, h.run(true, checks))
+	case len(parts) == 3 && parts[0] == "checks" && parts[2] == "run" && (r.Method == http.MethodGet || r.Method == http.MethodPost):
+		checks := h.findChecks(parts[1])
+		if len(checks) == 0 {
+			writeAPIError(w, http.StatusNotFound, fmt.Sprintf("check %s not found", parts[1]))
+			return
+		}
+		writeAPIResult(w, h.run(false, checks))
+	case len(parts) == 2 && parts[0] == "users" && r.Method == http.MethodGet:
+		h.mu.Lock()
+		report, out, err := runUserNexusConn(h.checks, parts[1], h.nxconn, h.opts)
+		h.mu.Unlock()
+		writeAPIResult(w, newAPIResult(report, out, err))
+	default:
+		writeAPIError(w, http.StatusNotFound, "not found")
+	}
+}
+
+func (h *Handler) run(apply bool, checks []*UsersCheck) *APIResult {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	report, out, err := runNexusConn(apply, checks, h.nxconn, h.opts)
+	h.last = newAPIResult(report, out, err)
+	return h.last
+}
+
+func (h *Handler) findChecks(name string) []*UsersCheck {
+	checks := []*UsersCheck{}
+	for _, check := range h.checks {
+		if check.Name == name || (check.Name == "" && check.Prefix == name) {
+			checks = append(checks, check)
+		}
+	}
+	return checks
+}
+
+func newAPIResult(report *Report, out string, err error) *APIResult {
+	res := &APIResult{Ok: err == nil, Output: out, Report: report}
+	if err != nil {
+		res.Error = err.Error()
+	}
+	return res
+}
+
+func writeAPIResult(w http.ResponseWriter, res *APIResult) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
+
+func writeAPIError(w http.ResponseWriter, code int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(&APIResult{Output: msg, Error: msg})
+}
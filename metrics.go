@@ -0,0 +1,203 @@
+package nxusercheck
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Metrics keeps drift metrics of the observed runs and exposes them in the
+// Prometheus text format, through an http handler or a textfile collector file.
+type Metrics struct {
+	sync.Mutex
+	counters map[string]float64
+	gauges   map[string]float64
+	// Environment of each per check gauge
+	gaugeEnvs map[string]string
+}
+
+type metricDesc struct {
+	name string
+	kind string
+	help string
+}
+
+var metricDescs = []metricDesc{
+	{"nxusercheck_runs_total", "counter", "Number of runs."},
+	{"nxusercheck_run_failures_total", "counter", "Number of runs that returned an error."},
+	{"nxusercheck_applied_changes_total", "counter", "Number of changes applied successfully."},
+	{"nxusercheck_apply_failures_total", "counter", "Number of changes that failed to apply."},
+	{"nxusercheck_last_run_timestamp_seconds", "gauge", "Start time of the last run."},
+	{"nxusercheck_last_run_duration_seconds", "gauge", "Duration of the last run."},
+	{"nxusercheck_last_run_success", "gauge", "Whether the last run succeeded."},
+	{"nxusercheck_users_checked", "gauge", "Number of users checked on the last run."},
+	{"nxusercheck_check_errors", "gauge", "Whether the check failed on the last run."},
+	{"nxusercheck_findings", "gauge", "Number of findings on the last run."},
+}
+
+var (
+	fileMetricsMu sync.Mutex
+	fileMetricsBy = map[string]*Metrics{}
+)
+
+// fileMetrics returns the Metrics of a metrics file, kept for the whole
+// process so its counters keep adding up across runs.
+func fileMetrics(file string) *Metrics {
+	fileMetricsMu.Lock()
+	defer fileMetricsMu.Unlock()
+	if m, ok := fileMetricsBy[file]; ok {
+		return m
+	}
+	m := NewMetrics()
+	fileMetricsBy[file] = m
+	return m
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{counters: map[string]float64{}, gauges: map[string]float64{}, gaugeEnvs: map[string]string{}}
+}
+
+func (m *Metrics) Observe(r *Report) {
+	m.Lock()
+	defer m.Unlock()
+
+	mode := "check"
+	if r.Apply {
+		mode = "apply"
+	}
+	modeLabel := labels("mode", mode)
+	m.counters["nxusercheck_runs_total"+modeLabel]++
+	if r.Error != "" {
+		m.counters["nxusercheck_run_failures_total"+modeLabel]++
+	}
+
+	// Per check gauges describe the last run of their environment only
+	envs := map[string]bool{}
+	for _, cr := range r.Checks {
+		envs[cr.Environment] = true
+	}
+	for key, env := range m.gaugeEnvs {
+		if envs[env] {
+			delete(m.gauges, key)
+			delete(m.gaugeEnvs, key)
+		}
+	}
+	m.gauges["nxusercheck_last_run_timestamp_seconds"+modeLabel] = float64(r.Start.UnixNano()) / 1e9
+	m.gauges["nxusercheck_last_run_duration_seconds"+modeLabel] = r.Duration.Seconds()
+	success := 1.0
+	if r.Error != "" {
+		success = 0
+	}
+	m.gauges["nxusercheck_last_run_success"+modeLabel] = success
+
+	for _, cr := range r.Checks {
+		checkLabels := func(kv ...string) string {
+			base := []string{"check", cr.Prefix}
+			if cr.Environment != "" {
+				base = append([]string{"environment", cr.Environment}, base...)
+			}
+			return labels(append(base, kv...)...)
+		}
+		gauge := func(name string, lbls string) string {
+			key := name + lbls
+			m.gaugeEnvs[key] = cr.Environment
+			return key
+		}
+		m.gauges[gauge("nxusercheck_users_checked", checkLabels())] += float64(len(cr.Users))
+		checkErr := 0.0
+		if cr.Error != "" {
+			checkErr = 1
+		}
+		m.gauges[gauge("nxusercheck_check_errors", checkLabels())] = checkErr
+		for _, ur := range cr.Users {
+			for _, f := range ur.Findings {
+				m.gauges[gauge("nxusercheck_findings", checkLabels("kind", f.Kind, "category", f.Category, "severity", f.Severity))]++
+			}
+			for _, rec := range ur.Applied {
+				if rec.Outcome == AuditOutcomeOk {
+					m.counters["nxusercheck_applied_changes_total"+checkLabels("op", rec.Op)]++
+				} else {
+					m.counters["nxusercheck_apply_failures_total"+checkLabels("op", rec.Op)]++
+				}
+			}
+		}
+	}
+}
+
+func (m *Metrics) WriteTo(w io.Writer) (int64, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	buf := &bytes.Buffer{}
+	for _, desc := range metricDescs {
+		values := m.counters
+		if desc.kind == "gauge" {
+			values = m.gauges
+		}
+		keys := []string{}
+		for key := range values {
+			if metricName(key) == desc.name {
+				keys = append(keys, key)
+			}
+		}
+		if len(keys) == 0 {
+			continue
+		}
+		sort.Strings(keys)
+		fmt.Fprintf(buf, "# HELP %s %s\n# TYPE %s %s\n", desc.name, desc.help, desc.name, desc.kind)
+		for _, key := range keys {
+			fmt.Fprintf(buf, "%s %v\n", key, values[key])
+		}
+	}
+	return buf.WriteTo(w)
+}
+
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	m.WriteTo(w)
+}
+
+func (m *Metrics) WriteTextfile(file string) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(file), filepath.Base(file)+".tmp")
+	if err != nil {
+		return fmt.Errorf("Error writing metrics file %s: %s", file, err.Error())
+	}
+	defer os.Remove(tmp.Name())
+	if _, err = m.WriteTo(tmp); err != nil {
+		tmp.Close()
+		return fmt.Errorf("Error writing metrics file %s: %s", file, err.Error())
+	}
+	if err = tmp.Close(); err != nil {
+		return fmt.Errorf("Error writing metrics file %s: %s", file, err.Error())
+	}
+	if err = os.Chmod(tmp.Name(), 0644); err != nil {
+		return fmt.Errorf("Error writing metrics file %s: %s", file, err.Error())
+	}
+	if err = os.Rename(tmp.Name(), file); err != nil {
+		return fmt.Errorf("Error writing metrics file %s: %s", file, err.Error())
+	}
+	return nil
+}
+
+func metricName(key string) string {
+	if i := strings.Index(key, "{"); i >= 0 {
+		return key[:i]
+	}
+	return key
+}
+
+func labels(kv ...string) string {
+	ls := []string{}
+	for i := 0; i+1 < len(kv); i += 2 {
+		value := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(kv[i+1])
+		ls = append(ls, fmt.Sprintf(`%s="%s"`, kv[i], value))
+	}
+	return "{" + strings.Join(ls, ",") + "}"
+}
@@ -0,0 +1,275 @@
+package nxusercheck
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/jaracil/ei"
+	nx "github.com/nayarsystems/nxgo/nxcore"
+)
+
+// Migration copies the templates and tags (including permissions) of a user,
+// and of its sub users with Subtree, to a new name. With RewritePrefixes the
+// tags and permissions on prefixes under From are moved under To. The copies
+// are applied and verified as checks of the new users, and the originals are
+// only deleted (with DeleteOriginals) once verified. Passwords can't be copied
+// so new users get a random one.
+type Migration struct {
+	From            string `json:"from"`
+	To              string `json:"to"`
+	Subtree         bool   `json:"subtree"`
+	RewritePrefixes bool   `json:"rewritePrefixes"`
+	Overwrite       bool   `json:"overwrite"`
+	DeleteOriginals bool   `json:"deleteOriginals"`
+}
+
+// PlanMigrationNexusConn lists what MigrateNexusConn would do without
+// changing anything.
+func PlanMigrationNexusConn(m *Migration, nxconn *nx.NexusConn, opts ...*CheckOpts) (string, error) {
+	_, out, err := runMigration(false, m, nxconn, firstOpts(opts))
+	return out, err
+}
+
+func MigrateNexusConn(m *Migration, nxconn *nx.NexusConn, opts ...*CheckOpts) (string, error) {
+	_, out, err := runMigration(true, m, nxconn, firstOpts(opts))
+	return out, err
+}
+
+func PlanMigration(m *Migration, nexusHost string, nexusUser string, nexusPass string, opts ...*CheckOpts) (string, error) {
+	return migrateNexus(false, m, nexusHost, nexusUser, nexusPass, firstOpts(opts))
+}
+
+func Migrate(m *Migration, nexusHost string, nexusUser string, nexusPass string, opts ...*CheckOpts) (string, error) {
+	return migrateNexus(true, m, nexusHost, nexusUser, nexusPass, firstOpts(opts))
+}
+
+func migrateNexus(apply bool, m *Migration, nexusHost string, nexusUser string, nexusPass string, opts *CheckOpts) (string, error) {
+	opt := *opts
+	if opt.AuditActor == "" {
+		opt.AuditActor = nexusUser
+	}
+	nxconn, err := getNexusConn(nexusHost, nexusUser, nexusPass)
+	if err != nil {
+		return err.Error(), err
+	}
+	defer nxconn.Close()
+	_, out, err := runMigration(apply, m, nxconn, &opt)
+	return out, err
+}
+
+func (m *Migration) validate() error {
+	if m.From == "" || m.To == "" {
+		return fmt.Errorf("Error in migration: missing from or to")
+	}
+	if m.From == m.To {
+		return fmt.Errorf("Error in migration: from and to are the same user")
+	}
+	if m.Subtree && (underPrefix(m.To, m.From) || underPrefix(m.From, m.To)) {
+		return fmt.Errorf("Error in migration: %s and %s overlap", m.From, m.To)
+	}
+	return nil
+}
+
+func (m *Migration) rename(name string) string {
+	return m.To + strings.TrimPrefix(name, m.From)
+}
+
+// check returns the check of the copy of a user.
+func (m *Migration) check(src *nx.UserInfo) *UsersCheck {
+	uc := &UsersCheck{
+		Name:               fmt.Sprintf("copy of %s", src.User),
+		Prefix:             m.rename(src.User),
+		CreateMissing:      Bool(true),
+		Templates:          append([]string{}, src.Templates...),
+		NoExtraTags:        Bool(true),
+		NoExtraPermissions: Bool(true),
+		Tags:               &Tags{ByPrefix: T{}},
+		Permissions:        &Permissions{ByPrefix: P{}},
+	}
+	for prefix, tagval := range src.Tags {
+		if m.RewritePrefixes && underPrefix(prefix, m.From) {
+			prefix = m.rename(prefix)
+		}
+		for key, value := range tagval {
+			if strings.HasPrefix(key, "@") {
+				if uc.Permissions.ByPrefix[prefix] == nil {
+					uc.Permissions.ByPrefix[prefix] = map[string]bool{}
+				}
+				uc.Permissions.ByPrefix[prefix][key] = ei.N(value).BoolZ()
+			} else {
+				addPrefTagVal(uc.Tags.ByPrefix, prefix, key, value)
+			}
+		}
+	}
+	return uc
+}
+
+func (m *Migration) sources(nxconn *nx.NexusConn, opts *CheckOpts) ([]nx.UserInfo, error) {
+	listOpts := &nx.ListOpts{}
+	if !m.Subtree {
+		listOpts.LimitByDepth = true
+		listOpts.Depth = 0
+	}
+	var users []nx.UserInfo
+	err := opts.retry("", func() (err error) {
+		users, err = nxconn.UserList(m.From, 0, 0, listOpts)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Error listing users on %s: %s", m.From, err.Error())
+	}
+	sources := []nx.UserInfo{}
+	for _, user := range users {
+		if user.User == m.From || m.Subtree && underPrefix(user.User, m.From) {
+			sources = append(sources, user)
+		}
+	}
+	if len(sources) == 0 {
+		return nil, fmt.Errorf("Error listing users on %s: no users found", m.From)
+	}
+	// Parents are created before their sub users
+	sort.Slice(sources, func(i, j int) bool { return sources[i].User < sources[j].User })
+	return sources, nil
+}
+
+func userExists(nxconn *nx.NexusConn, user string, opts *CheckOpts) (bool, error) {
+	var users []nx.UserInfo
+	err := opts.retry("", func() (err error) {
+		users, err = nxconn.UserList(user, 0, 0, &nx.ListOpts{LimitByDepth: true, Depth: 0})
+		return err
+	})
+	if err != nil {
+		return false, fmt.Errorf("Error listing users on %s: %s", user, err.Error())
+	}
+	for _, u := range users {
+		if u.User == user {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func runMigration(apply bool, m *Migration, nxconn *nx.NexusConn, opts *CheckOpts) (*Report, string, error) {
+	opt := *opts
+	// The copies must be exact
+	opt.Severity, opt.Exemptions, opt.Rules, opt.ExprRules = nil, nil, nil, nil
+	opt.AllowExtraTemplates, opt.NoExtraTags, opt.NoExtraPermissions, opt.CreateMissing = Bool(false), Bool(true), Bool(true), Bool(true)
+	fail := func(err error) (*Report, string, error) {
+		report := newReport(apply)
+		report.Error = err.Error()
+		return report, err.Error(), err
+	}
+	if err := m.validate(); err != nil {
+		return fail(err)
+	}
+	sources, err := m.sources(nxconn, &opt)
+	if err != nil {
+		return fail(err)
+	}
+	checks := []*UsersCheck{}
+	plan := []string{}
+	for i := range sources {
+		uc := m.check(&sources[i])
+		exists, err := userExists(nxconn, uc.Prefix, &opt)
+		if err != nil {
+			return fail(err)
+		}
+		desc := fmt.Sprintf("%s -> %s: templates %s, %d tag prefixes, %d permission prefixes", sources[i].User, uc.Prefix, jsonValue(uc.Templates), len(uc.Tags.ByPrefix), len(uc.Permissions.ByPrefix))
+		if exists {
+			if !m.Overwrite {
+				return fail(fmt.Errorf("Error migrating %s: %s already exists", sources[i].User, uc.Prefix))
+			}
+			desc += " (overwrites existing user)"
+		}
+		checks = append(checks, uc)
+		plan = append(plan, desc)
+	}
+	if m.DeleteOriginals {
+		plan = append(plan, fmt.Sprintf("Delete %d original users", len(sources)))
+	}
+	if !apply {
+		return newReport(false), fmt.Sprintf("MIGRATION PLAN:\n\n\t* %s\n", strings.Join(plan, "\n\t* ")), nil
+	}
+
+	report, out, err := runNexusConn(true, checks, nxconn, &opt)
+	if err != nil {
+		return report, fmt.Sprintf("%s\nOriginal users kept", out), err
+	}
+	outs := []string{out}
+
+	verifyOpt := opt
+	verifyOpt.Audit, verifyOpt.AuditLog, verifyOpt.Metrics, verifyOpt.MetricsFile = nil, "", nil, ""
+	if _, verifyOut, err := runNexusConn(false, checks, nxconn, &verifyOpt); err != nil {
+		err = fmt.Errorf("Error verifying migration: %s", err.Error())
+		report.Error = err.Error()
+		return report, fmt.Sprintf("%s\n%s\n%s\nOriginal users kept", out, verifyOut, err.Error()), err
+	}
+	outs = append(outs, fmt.Sprintf("%d users copied and verified", len(checks)))
+
+	if m.DeleteOriginals {
+		deleteOut, err := m.deleteOriginals(sources, nxconn, report, &opt)
+		outs = append(outs, deleteOut)
+		if err != nil {
+			report.Error = err.Error()
+			return report, strings.Join(outs, "\n"), err
+		}
+	}
+	return report, strings.Join(outs, "\n"), nil
+}
+
+// deleteOriginals deletes the migrated users, sub users first, recording the
+// deletions in a check of the report. Each deletion is confirmed, and skipped
+// deletions fail the migration.
+func (m *Migration) deleteOriginals(sources []nx.UserInfo, nxconn *nx.NexusConn, report *Report, opts *CheckOpts) (string, error) {
+	opt := *opts
+	opt.report = report
+	closeAudit, err := opt.openAudit()
+	if err != nil {
+		return err.Error(), err
+	}
+	defer closeAudit()
+	check := &UsersCheck{Name: "delete originals", Prefix: m.From, OnlySubUsers: false}
+	opt.startCheck(check)
+	deleted := 0
+	errs := []string{}
+	for i := len(sources) - 1; i >= 0; i-- {
+		user := sources[i].User
+		ur := opt.userReport(user)
+		op := &PlanOp{Op: AuditDeleteUser, Key: user}
+		ur.Plan = append(ur.Plan, op)
+		ok, err := opt.confirm(ur, []*PlanOp{op})
+		if err != nil {
+			opt.doneCheck(err)
+			return fmt.Sprintf("%d original users deleted\n%s", deleted, err.Error()), err
+		}
+		if !ok {
+			errs = append(errs, fmt.Sprintf("Error deleting %s: skipped", user))
+			continue
+		}
+		if !opt.beforeApply(user, op) {
+			errs = append(errs, fmt.Sprintf("Error deleting %s: skipped", user))
+			continue
+		}
+		err = opt.retry(user, func() error {
+			_, err := nxconn.UserDelete(user)
+			return err
+		})
+		if auditErr := opt.audit(user, AuditDeleteUser, "", "", nil, nil, err); err == nil {
+			err = auditErr
+		}
+		if err != nil {
+			errs = append(errs, (&ApplyError{User: user, Op: AuditDeleteUser, Err: err}).Error())
+			continue
+		}
+		deleted++
+	}
+	out := fmt.Sprintf("%d original users deleted", deleted)
+	if len(errs) != 0 {
+		err = fmt.Errorf("%s", strings.Join(errs, "\n"))
+		opt.doneCheck(err)
+		return fmt.Sprintf("%s\n%s", out, err.Error()), err
+	}
+	opt.doneCheck(nil)
+	return out, nil
+}
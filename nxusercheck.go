@@ -2,11 +2,12 @@ package nxusercheck
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io/ioutil"
-	"os"
 	"reflect"
+	"sort"
 	"strings"
+	"time"
 
 	"github.com/jaracil/ei"
 
@@ -16,18 +17,29 @@ import (
 
 type UsersCheck struct {
 	nexusConn           *nx.NexusConn
+	source              string
+	Name                string       `json:"name"`
 	Prefix              string       `json:"prefix"`
-	CreateMissing       bool         `json:"createMissing"`
+	CreateMissing       *bool        `json:"createMissing"`
 	OnlySubUsers        bool         `json:"onlySubUsers"`
 	Templates           []string     `json:"templates"`
-	AllowExtraTemplates bool         `json:"allowExtraTemplates"`
+	AllowExtraTemplates *bool        `json:"allowExtraTemplates"`
 	Permissions         *Permissions `json:"permissions"`
-	NoExtraPermissions  bool         `json:"noExtraPermissions"`
+	NoExtraPermissions  *bool        `json:"noExtraPermissions"`
 	Tags                *Tags        `json:"tags"`
-	NoExtraTags         bool         `json:"noExtraTags"`
-
+	NoExtraTags         *bool        `json:"noExtraTags"`
+	Roles               []string     `json:"roles"`
+	Severity            Severities   `json:"severity"`
+	Rules               []Rule       `json:"-"`
+	ExprRules           []*ExprRule  `json:"rules"`
+	Environments        []string     `json:"environments"`
+
+	fullTemplates   []string
 	fullPermissions T
 	fullTags        T
+	sources         map[string]string
+	conflicts       []*Conflict
+	exprRules       []Rule
 }
 
 type Permissions struct {
@@ -46,18 +58,47 @@ type T map[string]map[string]interface{}
 
 type CheckOpts struct {
 	apply               bool
-	AllowExtraTemplates bool `json:"allowExtraTemplates"`
-	NoExtraPermissions  bool `json:"noExtraPermissions"`
-	NoExtraTags         bool `json:"noExtraTags"`
-	CreateMissing       bool `json:"createMissing"`
+	AllowExtraTemplates *bool            `json:"allowExtraTemplates"`
+	NoExtraPermissions  *bool            `json:"noExtraPermissions"`
+	NoExtraTags         *bool            `json:"noExtraTags"`
+	CreateMissing       *bool            `json:"createMissing"`
+	AuditLog            string           `json:"auditLog"`
+	Audit               AuditSink        `json:"-"`
+	AuditActor          string           `json:"-"`
+	MetricsFile         string           `json:"metricsFile"`
+	Metrics             *Metrics         `json:"-"`
+	Severity            Severities       `json:"severity"`
+	FailOnWarnings      *bool            `json:"failOnWarnings"`
+	ContinueOnError     *bool            `json:"continueOnError"`
+	Retry               *RetryOpts       `json:"retry"`
+	Output              string           `json:"output"`
+	Template            string           `json:"template"`
+	TemplateFile        string           `json:"templateFile"`
+	Roles               map[string]*Role `json:"-"`
+	Exemptions          []*Exemption     `json:"-"`
+	Observer            Observer         `json:"-"`
+	Confirm             ConfirmFunc      `json:"-"`
+	Rules               []Rule           `json:"-"`
+	ExprRules           []*ExprRule      `json:"rules"`
+
+	file           *CheckOpts
+	environment    string
+	check          *UsersCheck
+	acceptAll      bool
+	report         *Report
+	checkReport    *CheckReport
+	exemptionsUsed map[*Exemption]bool
 }
 
 type userChecksFromFile struct {
-	Checks    []*UsersCheck `json:"checks"`
-	Opts      *CheckOpts    `json:"opts"`
-	NexusHost string        `json:"nexusHost"`
-	NexusUser string        `json:"nexusUser"`
-	NexusPass string        `json:"nexusPass"`
+	Roles        map[string]*Role        `json:"roles"`
+	Exemptions   []*Exemption            `json:"exemptions"`
+	Checks       []*UsersCheck           `json:"checks"`
+	Opts         *CheckOpts              `json:"opts"`
+	NexusHost    string                  `json:"nexusHost"`
+	NexusUser    string                  `json:"nexusUser"`
+	NexusPass    string                  `json:"nexusPass"`
+	Environments map[string]*Environment `json:"environments"`
 }
 
 func CheckFile(file string, opts ...*CheckOpts) (string, error) {
@@ -92,6 +133,11 @@ func Apply(checks []*UsersCheck, nexusHost string, nexusUser string, nexusPass s
 	return checkApply(true, checks, nexusHost, nexusUser, nexusPass, opts...)
 }
 
+func CheckUserNexusConn(checks []*UsersCheck, user string, nxconn *nx.NexusConn, opts ...*CheckOpts) (string, error) {
+	_, out, err := runUserNexusConn(checks, user, nxconn, firstOpts(opts))
+	return out, err
+}
+
 func CheckNexusConn(checks []*UsersCheck, nxconn *nx.NexusConn, opts ...*CheckOpts) (string, error) {
 	return checkApplyNexusConn(false, checks, nxconn, opts...)
 }
@@ -105,7 +151,7 @@ func checkApplyFile(apply bool, file string, opts ...*CheckOpts) (string, error)
 	if err != nil {
 		return err.Error(), err
 	}
-	return checkApply(apply, checks, host, user, pass, opt)
+	return checkApply(apply, checks, host, user, pass, layerOpts(opt, firstOpts(opts)))
 }
 
 func checkApplyFileNexus(apply bool, file string, nexusHost string, nexusUser string, nexusPass string, opts ...*CheckOpts) (string, error) {
@@ -113,7 +159,7 @@ func checkApplyFileNexus(apply bool, file string, nexusHost string, nexusUser st
 	if err != nil {
 		return err.Error(), err
 	}
-	return checkApply(apply, checks, nexusHost, nexusUser, nexusPass, opt)
+	return checkApply(apply, checks, nexusHost, nexusUser, nexusPass, layerOpts(opt, firstOpts(opts)))
 }
 
 func checkApplyFileNexusConn(apply bool, file string, nxconn *nx.NexusConn, opts ...*CheckOpts) (string, error) {
@@ -121,7 +167,7 @@ func checkApplyFileNexusConn(apply bool, file string, nxconn *nx.NexusConn, opts
 	if err != nil {
 		return err.Error(), err
 	}
-	return checkApplyNexusConn(apply, checks, nxconn, opt)
+	return checkApplyNexusConn(apply, checks, nxconn, layerOpts(opt, firstOpts(opts)))
 }
 
 func getNexusConn(nexusHost string, nexusUser string, nexusPass string) (*nx.NexusConn, error) {
@@ -137,41 +183,101 @@ func getNexusConn(nexusHost string, nexusUser string, nexusPass string) (*nx.Nex
 }
 
 func checkApply(apply bool, checks []*UsersCheck, nexusHost string, nexusUser string, nexusPass string, opts ...*CheckOpts) (string, error) {
+	opt := *firstOpts(opts)
+	if opt.AuditActor == "" {
+		opt.AuditActor = nexusUser
+	}
+	// Runs failing before connecting are observed too
+	fail := func(err error) (string, error) {
+		opt.report = newReport(apply)
+		opt.report.Error = err.Error()
+		opt.observeReport()
+		return err.Error(), err
+	}
+	if err := checkConflicts(checks, &opt); err != nil {
+		return fail(err)
+	}
 	nxconn, err := getNexusConn(nexusHost, nexusUser, nexusPass)
 	if err != nil {
-		return err.Error(), err
+		return fail(err)
 	}
 	defer nxconn.Close()
-	return checkApplyNexusConn(apply, checks, nxconn, opts...)
+	return checkApplyNexusConn(apply, checks, nxconn, &opt)
 }
 
 func checkApplyNexusConn(apply bool, checks []*UsersCheck, nxconn *nx.NexusConn, opts ...*CheckOpts) (string, error) {
+	_, out, err := runNexusConn(apply, checks, nxconn, firstOpts(opts))
+	return out, err
+}
+
+func runNexusConn(apply bool, checks []*UsersCheck, nxconn *nx.NexusConn, opts *CheckOpts) (*Report, string, error) {
+	opt := *opts
+	opt.report = newReport(apply)
+	defer opt.observeReport()
+	if conflicts, err := analyzeConflicts(checks, &opt); err != nil {
+		opt.report.Error = err.Error()
+		return opt.report, err.Error(), err
+	} else if len(conflicts) != 0 {
+		opt.report.Conflicts = conflicts
+		err = errors.New(formatConflicts(conflicts))
+		opt.report.Error = err.Error()
+		return opt.report, err.Error(), err
+	}
+	if err := validateExemptions(opt.Exemptions); err != nil {
+		opt.report.Error = err.Error()
+		return opt.report, err.Error(), err
+	}
+	if apply {
+		closeAudit, err := opt.openAudit()
+		if err != nil {
+			opt.report.Error = err.Error()
+			return opt.report, err.Error(), err
+		}
+		defer closeAudit()
+	}
+	opt.exemptionsUsed = map[*Exemption]bool{}
+
 	outs := []string{}
-	errs := []string{}
+	errs := []error{}
 
 	if apply {
 		for _, check := range checks {
-			hasCheckErr, checkOut, err := check.apply(nxconn, opts...)
+			opt.startCheck(check)
+			hasCheckErr, checkOut, err := check.apply(nxconn, &opt)
+			if users := opt.checkReport.unresolved(); err == nil && len(users) != 0 {
+				err = fmt.Errorf("Error applying check %s: %s not fixed", check.Prefix, strings.Join(users, ", "))
+			}
+			opt.doneCheck(err)
 			if checkOut != "" {
 				outs = append(outs, checkOut)
 			}
-			if err != nil {
+			if errors.Is(err, ErrAborted) {
 				outs = append(outs, err.Error())
-				errs = append(errs, err.Error())
+				errs = append(errs, err)
+				break
+			} else if err != nil {
+				outs = append(outs, err.Error())
+				errs = append(errs, err)
+			} else if opt.failOnWarnings() && opt.checkReport.hasSeverity(SeverityWarning) {
+				warnErr := fmt.Sprintf("%s has warnings", check.Prefix)
+				outs = append(outs, warnErr)
+				errs = append(errs, errors.New(warnErr))
 			} else if !hasCheckErr {
 				outs = append(outs, fmt.Sprintf("%s passed all checks", check.Prefix))
 			}
 		}
 	} else {
 		for _, check := range checks {
-			hasCheckErr, checkOut, err := check.check(nxconn, opts...)
+			opt.startCheck(check)
+			hasCheckErr, checkOut, err := check.check(nxconn, &opt)
+			opt.doneCheck(err)
 			if err != nil {
 				outs = append(outs, err.Error())
-				errs = append(errs, err.Error())
+				errs = append(errs, err)
 			} else if hasCheckErr {
 				if checkOut != "" {
 					outs = append(outs, checkOut)
-					errs = append(errs, checkOut)
+					errs = append(errs, errors.New(checkOut))
 				}
 			} else {
 				if checkOut != "" {
@@ -182,33 +288,118 @@ func checkApplyNexusConn(apply bool, checks []*UsersCheck, nxconn *nx.NexusConn,
 		}
 	}
 
+	if exemptionsOut := opt.reportExemptions(); exemptionsOut != "" {
+		outs = append(outs, exemptionsOut)
+	}
+	if applied, failed := opt.report.applySummary(); apply && applied+failed != 0 {
+		outs = append(outs, fmt.Sprintf("%d changes applied, %d failed", applied, failed))
+	}
+
 	if len(errs) != 0 {
-		return strings.Join(outs, "\n"), fmt.Errorf(strings.Join(errs, "\n"))
+		err := errors.Join(errs...)
+		opt.report.Error = err.Error()
+		return opt.report, opt.render(opt.report, strings.Join(outs, "\n")), err
 	} else {
 		outs = append(outs, fmt.Sprintf("%d checks passed successfully", len(checks)))
-		return strings.Join(outs, "\n"), nil
+		return opt.report, opt.render(opt.report, strings.Join(outs, "\n")), nil
 	}
 }
 
-func getUserChecksFromFile(file string) ([]*UsersCheck, *CheckOpts, string, string, string, error) {
-	jsonFile, err := os.Open(file)
-	if err != nil {
-		return nil, nil, "", "", "", fmt.Errorf("Error opening file %s: %s", file, err.Error())
+func runUserNexusConn(checks []*UsersCheck, user string, nxconn *nx.NexusConn, opts *CheckOpts) (*Report, string, error) {
+	opt := *opts
+	opt.apply = false
+	opt.report = newReport(false)
+	defer func() { opt.report.Duration = time.Since(opt.report.Start) }()
+	fail := func(err error) (*Report, string, error) {
+		opt.report.Error = err.Error()
+		return opt.report, err.Error(), err
+	}
+
+	matching := []*UsersCheck{}
+	for _, check := range checks {
+		if check.targets(user) {
+			matching = append(matching, check)
+		}
+	}
+	if len(matching) == 0 {
+		return fail(fmt.Errorf("Error checking user %s: no checks match the user", user))
 	}
-	defer jsonFile.Close()
-	byteValue, err := ioutil.ReadAll(jsonFile)
+	if conflicts, err := analyzeConflicts(matching, &opt); err != nil {
+		return fail(err)
+	} else if len(conflicts) != 0 {
+		opt.report.Conflicts = conflicts
+		return fail(errors.New(formatConflicts(conflicts)))
+	}
+
+	var users []nx.UserInfo
+	err := opt.retry("", func() (err error) {
+		users, err = nxconn.UserList(user, 0, 0, &nx.ListOpts{LimitByDepth: true, Depth: 0})
+		return err
+	})
 	if err != nil {
-		return nil, nil, "", "", "", fmt.Errorf("Error reading file %s: %s", file, err.Error())
+		return fail(fmt.Errorf("Error listing users on %s: %s", user, err.Error()))
+	}
+	var userInfo *nx.UserInfo
+	for i := range users {
+		if users[i].User == user {
+			userInfo = &users[i]
+		}
+	}
+	if userInfo == nil {
+		return fail(fmt.Errorf("Error listing users on %s: no users found", user))
+	}
+
+	outs := []string{}
+	errs := []string{}
+	for _, check := range matching {
+		opt.startCheck(check)
+		if err := check.init(nxconn, &opt); err != nil {
+			opt.doneCheck(err)
+			outs = append(outs, err.Error())
+			errs = append(errs, err.Error())
+			continue
+		}
+		opt.onUser(user)
+		checkOk, checkOut, _ := check.checkUser(userInfo, &opt)
+		opt.doneCheck(nil)
+		if checkOut != "" {
+			outs = append(outs, checkOut)
+		}
+		if !checkOk {
+			errs = append(errs, checkOut)
+		} else {
+			outs = append(outs, fmt.Sprintf("%s passed %s", user, check.label()))
+		}
+	}
+	if len(errs) != 0 {
+		opt.report.Error = strings.Join(errs, "\n")
+		return opt.report, opt.render(opt.report, strings.Join(outs, "\n")), errors.New(strings.Join(errs, "\n"))
+	}
+	return opt.report, opt.render(opt.report, strings.Join(outs, "\n")), nil
+}
+
+func (uc *UsersCheck) targets(user string) bool {
+	if uc.OnlySubUsers {
+		return isSubUser(user, uc.Prefix)
 	}
-	var ucff *userChecksFromFile
-	err = json.Unmarshal(byteValue, &ucff)
+	return user == uc.Prefix
+}
+
+func getUserChecksFromFile(file string) ([]*UsersCheck, *CheckOpts, string, string, string, error) {
+	ucff, err := loadConfig(file)
 	if err != nil {
-		return nil, nil, "", "", "", fmt.Errorf("Error unmarshaling json from file %s: %s", file, err.Error())
+		return nil, nil, "", "", "", err
 	}
+	return ucff.defaultChecks(), ucff.fileOpts(), ucff.NexusHost, ucff.NexusUser, ucff.NexusPass, nil
+}
+
+func (ucff *userChecksFromFile) fileOpts() *CheckOpts {
 	if ucff.Opts == nil {
 		ucff.Opts = &CheckOpts{}
 	}
-	return ucff.Checks, ucff.Opts, ucff.NexusHost, ucff.NexusUser, ucff.NexusPass, nil
+	ucff.Opts.Roles = ucff.Roles
+	ucff.Opts.Exemptions = ucff.Exemptions
+	return ucff.Opts
 }
 
 func (uc *UsersCheck) check(nc *nx.NexusConn, opts ...*CheckOpts) (bool, string, error) {
@@ -216,7 +407,9 @@ func (uc *UsersCheck) check(nc *nx.NexusConn, opts ...*CheckOpts) (bool, string,
 	if len(opts) > 0 {
 		opt = opts[0]
 	}
-	uc.init(nc)
+	if err := uc.init(nc, opt); err != nil {
+		return false, "", err
+	}
 	opt.apply = false
 	return uc.checkApply(opt)
 }
@@ -226,49 +419,114 @@ func (uc *UsersCheck) apply(nc *nx.NexusConn, opts ...*CheckOpts) (bool, string,
 	if len(opts) > 0 {
 		opt = opts[0]
 	}
-	uc.init(nc)
+	if err := uc.init(nc, opt); err != nil {
+		return false, "", err
+	}
 	opt.apply = true
 	return uc.checkApply(opt)
 }
 
-func (uc *UsersCheck) init(nc *nx.NexusConn) {
+func (uc *UsersCheck) init(nc *nx.NexusConn, opts *CheckOpts) error {
 	uc.nexusConn = nc
-	uc.fullPermissions = map[string]map[string]interface{}{}
-	uc.fullTags = map[string]map[string]interface{}{}
+	if err := uc.prepare(opts); err != nil {
+		return fmt.Errorf("Error initializing check %s: %s", uc.Prefix, err.Error())
+	}
+	if len(uc.conflicts) != 0 {
+		return fmt.Errorf("Error initializing check %s: %s", uc.Prefix, uc.conflicts[0].String())
+	}
+	return nil
+}
+
+func (uc *UsersCheck) prepare(opts *CheckOpts) error {
+	uc.fullTemplates = nil
+	uc.fullPermissions = nil
+	uc.fullTags = nil
+	uc.sources = map[string]string{}
+	uc.conflicts = []*Conflict{}
+	uc.exprRules = []Rule{}
+
+	if err := uc.Severity.validate(); err != nil {
+		return err
+	}
+	if err := opts.validate(); err != nil {
+		return err
+	}
+	if uc.Templates != nil {
+		uc.fullTemplates = append([]string{}, uc.Templates...)
+	}
 	if uc.Permissions != nil {
-		for prefix, perms := range uc.Permissions.ByPrefix {
-			for perm, value := range perms {
-				if strings.HasPrefix(perm, "@") {
-					addPrefPermVal(uc.fullPermissions, prefix, perm, value)
-				}
+		uc.fullPermissions = T{}
+		uc.addPermissions(uc.fullPermissions, uc.Permissions, "permissions", "")
+	}
+	if uc.Tags != nil {
+		uc.fullTags = T{}
+		uc.addTags(uc.fullTags, uc.Tags, "tags", "")
+	}
+	for _, er := range append(append([]*ExprRule{}, opts.ExprRules...), uc.ExprRules...) {
+		if er == nil {
+			continue
+		}
+		rule, err := er.compile()
+		if err != nil {
+			return err
+		}
+		uc.exprRules = append(uc.exprRules, rule)
+	}
+	return uc.expandRoles(opts.Roles)
+}
+
+func (uc *UsersCheck) addPermissions(dest T, perms *Permissions, source string, param string) {
+	for prefix, pvals := range perms.ByPrefix {
+		for perm, value := range pvals {
+			if strings.HasPrefix(perm, "@") {
+				uc.addValue(dest, expandParam(prefix, param), perm, value, source+".byPrefix")
 			}
 		}
-		for perm, prefixes := range uc.Permissions.OnPrefixes {
-			for prefix, value := range prefixes {
-				if strings.HasPrefix(perm, "@") {
-					addPrefPermVal(uc.fullPermissions, prefix, perm, value)
-				}
+	}
+	for perm, prefixes := range perms.OnPrefixes {
+		for prefix, value := range prefixes {
+			if strings.HasPrefix(perm, "@") {
+				uc.addValue(dest, expandParam(prefix, param), perm, value, source+".onPrefixes")
 			}
 		}
 	}
-	if uc.Tags != nil {
-		for prefix, tags := range uc.Tags.ByPrefix {
-			for tag, value := range tags {
-				if !strings.HasPrefix(tag, "@") {
-					addPrefTagVal(uc.fullTags, prefix, tag, value)
-				}
+}
+
+func (uc *UsersCheck) addTags(dest T, tags *Tags, source string, param string) {
+	for prefix, tvals := range tags.ByPrefix {
+		for tag, value := range tvals {
+			if !strings.HasPrefix(tag, "@") {
+				uc.addValue(dest, expandParam(prefix, param), tag, value, source+".byPrefix")
 			}
 		}
-		for tag, prefixes := range uc.Tags.OnPrefixes {
-			for prefix, value := range prefixes {
-				if !strings.HasPrefix(tag, "@") {
-					addPrefTagVal(uc.fullTags, prefix, tag, value)
-				}
+	}
+	for tag, prefixes := range tags.OnPrefixes {
+		for prefix, value := range prefixes {
+			if !strings.HasPrefix(tag, "@") {
+				uc.addValue(dest, expandParam(prefix, param), tag, value, source+".onPrefixes")
 			}
 		}
 	}
 }
 
+func (uc *UsersCheck) addValue(dest T, prefix string, key string, val interface{}, source string) {
+	val = normalizeValue(val)
+	id := prefix + " " + key
+	if cur, ok := dest[prefix][key]; ok {
+		if !reflect.DeepEqual(cur, val) {
+			uc.conflicts = append(uc.conflicts, &Conflict{
+				Prefix: prefix,
+				Key:    key,
+				A:      ConflictSide{Check: uc.label(), Source: uc.sources[id], Value: cur},
+				B:      ConflictSide{Check: uc.label(), Source: source, Value: val},
+			})
+		}
+		return
+	}
+	uc.sources[id] = source
+	addPrefTagVal(dest, prefix, key, val)
+}
+
 func (uc *UsersCheck) checkApply(opts *CheckOpts) (bool, string, error) {
 	listOpts := &nx.ListOpts{}
 	if !uc.OnlySubUsers {
@@ -276,17 +534,25 @@ func (uc *UsersCheck) checkApply(opts *CheckOpts) (bool, string, error) {
 		listOpts.Depth = 0
 	}
 
-	users, err := uc.nexusConn.UserList(uc.Prefix, 0, 0, listOpts)
+	var users []nx.UserInfo
+	err := opts.retry("", func() (err error) {
+		users, err = uc.nexusConn.UserList(uc.Prefix, 0, 0, listOpts)
+		return err
+	})
 	if err != nil {
 		return false, "", fmt.Errorf("Error listing users on %s: %s", uc.Prefix, err.Error())
 	}
 
+	sort.Slice(users, func(i, j int) bool { return users[i].User < users[j].User })
+
 	hasCheckErr := false
 	checkOuts := []string{}
+	applyErrs := []error{}
 
 	done := 0
 	for _, user := range users {
 		if uc.OnlySubUsers == (user.User != uc.Prefix) {
+			opts.onUser(user.User)
 			checkOk, checkOut, applyErr := uc.checkUser(&user, opts)
 			if !checkOk {
 				hasCheckErr = true
@@ -295,18 +561,44 @@ func (uc *UsersCheck) checkApply(opts *CheckOpts) (bool, string, error) {
 				checkOuts = append(checkOuts, checkOut)
 			}
 			if opts.apply && applyErr != nil {
-				return hasCheckErr, strings.Join(checkOuts, "\n"), applyErr
+				if !opts.continueOnError() || errors.Is(applyErr, ErrAborted) {
+					return hasCheckErr, strings.Join(checkOuts, "\n"), applyErr
+				}
+				applyErrs = append(applyErrs, applyErr)
 			}
 			done++
 		}
 	}
 
 	if !uc.OnlySubUsers && done == 0 {
-		if opts.apply && (opts.CreateMissing || uc.CreateMissing) {
+		if opts.apply && uc.createMissing(opts) {
 			crOut := fmt.Sprintf("%s does not exist", uc.Prefix)
-			if _, err = uc.nexusConn.UserCreate(uc.Prefix, randomPass(12)); err != nil {
-				return true, crOut, fmt.Errorf("Error creating user %s: %s", uc.Prefix, err.Error())
+			createOp := &PlanOp{Op: AuditCreate, Key: uc.Prefix}
+			ur := opts.userReport(uc.Prefix)
+			ur.Plan = append(ur.Plan, createOp)
+			if accept, err := opts.confirm(ur, []*PlanOp{createOp}); err != nil {
+				return true, crOut, err
+			} else if !accept || !opts.beforeApply(uc.Prefix, createOp) {
+				return true, fmt.Sprintf("%s, creation skipped", crOut), nil
+			}
+			attempts := 0
+			err = opts.retry(uc.Prefix, func() error {
+				attempts++
+				_, err := uc.nexusConn.UserCreate(uc.Prefix, randomPass(12))
+				// A retried create may have succeeded on a timed out attempt
+				var jerr *nx.JsonRpcErr
+				if attempts > 1 && errors.As(err, &jerr) && jerr.Cod == nx.ErrUserExists {
+					return nil
+				}
+				return err
+			})
+			if auditErr := opts.audit(uc.Prefix, AuditCreate, "", "", nil, nil, err); err == nil {
+				err = auditErr
+			}
+			if err != nil {
+				return true, crOut, &ApplyError{User: uc.Prefix, Op: AuditCreate, Err: err}
 			}
+			opts.checkReport.setCreated()
 			ok, out, err := uc.checkApply(opts)
 			return ok, fmt.Sprintf("%s\n%s created\n%s", crOut, uc.Prefix, out), err
 		} else {
@@ -314,174 +606,204 @@ func (uc *UsersCheck) checkApply(opts *CheckOpts) (bool, string, error) {
 		}
 	}
 
-	return hasCheckErr, strings.Join(checkOuts, "\n"), nil
+	return hasCheckErr, strings.Join(checkOuts, "\n"), errors.Join(applyErrs...)
 }
 
 func (uc *UsersCheck) checkUser(userInfo *nx.UserInfo, opts *CheckOpts) (bool, string, error) {
-	// Check templates
-	var applyErr error
-	errOuts := []string{}
-	warnOuts := []string{}
-
-	if uc.Templates != nil {
-		if opts.AllowExtraTemplates || uc.AllowExtraTemplates {
-			if missing, ok := checkTemplatesOrderMatch(userInfo.Templates, uc.Templates); !ok {
-				errOuts = append(errOuts, fmt.Sprintf("\tWRONG TEMPLATES:\n\n\t* Has: %v\n\t* Wants in order: %v\n", userInfo.Templates, uc.Templates))
-				if opts.apply {
-					if err := applyTemplates(uc.nexusConn, userInfo, append(userInfo.Templates, missing...)); err != nil {
-						applyErr = fmt.Errorf("Error applying templates to %s: %s", userInfo.User, err.Error())
-					}
-				}
-			}
-		} else {
-			if !checkTemplatesExactMatch(userInfo.Templates, uc.Templates) {
-				errOuts = append(errOuts, fmt.Sprintf("\tWRONG TEMPLATES:\n\n\t* Has: %v\n\t* Wants exactly: %v\n", userInfo.Templates, uc.Templates))
-				if opts.apply {
-					if err := applyTemplates(uc.nexusConn, userInfo, uc.Templates); err != nil {
-						applyErr = fmt.Errorf("Error applying templates to %s: %s", userInfo.User, err.Error())
-					}
-				}
-			}
+	applyErrs := []error{}
+	var templatesPlan []*PlanOp
+	outs := map[string][]string{}
+	ur := opts.userReport(userInfo.User)
+	emitted := len(ur.Findings)
+	planned := len(ur.Plan)
+
+	// Check templates, planned along with the templates operations of the rules
+	templatesFound := map[string][]string{}
+	allowExtra := uc.allowExtraTemplates(opts)
+	if uc.fullTemplates != nil {
+		wrongOrder, missing, extra := diffTemplates(userInfo.Templates, uc.fullTemplates, allowExtra)
+		wrongOrder, missing, extra = opts.exemptTemplates(ur, wrongOrder, missing, extra)
+		if wrongOrder {
+			templatesFound[uc.severity(opts, KindTemplates, CategoryWrong)] = append(templatesFound[uc.severity(opts, KindTemplates, CategoryWrong)], "\t* Wrong order")
+		}
+		if len(missing) != 0 {
+			templatesFound[uc.severity(opts, KindTemplates, CategoryMissing)] = append(templatesFound[uc.severity(opts, KindTemplates, CategoryMissing)], fmt.Sprintf("\t* Missing: %s", jsonValue(missing)))
+		}
+		if len(extra) != 0 {
+			templatesFound[uc.severity(opts, KindTemplates, CategoryExtra)] = append(templatesFound[uc.severity(opts, KindTemplates, CategoryExtra)], fmt.Sprintf("\t* Extra: %s", jsonValue(extra)))
+		}
+		if wrongOrder {
+			ur.addTemplatesFinding(CategoryWrong, uc.severity(opts, KindTemplates, CategoryWrong), userInfo.Templates, uc.fullTemplates)
+		}
+		for _, tpl := range missing {
+			ur.addTemplateFinding(CategoryMissing, uc.severity(opts, KindTemplates, CategoryMissing), tpl)
+		}
+		for _, tpl := range extra {
+			ur.addTemplateFinding(CategoryExtra, uc.severity(opts, KindTemplates, CategoryExtra), tpl)
 		}
-		/* missing, ok := checkTemplatesAnyOrder(userInfo.Templates, uc.Templates) */
+		emitted = opts.emitFindings(ur, emitted)
 	}
 
+	// Tags and permissions are applied together
+	setWrong, set, del := T{}, T{}, T{}
+
 	// Check tags
-	if uc.Tags != nil {
-		if opts.NoExtraTags || uc.NoExtraTags {
-			if wrong, missing, extra, ok := checkTagsExactMatch(userInfo.Tags, uc.fullTags); !ok {
-				errOuts = append(errOuts, formatTagErrors(wrong, missing, extra))
-				if opts.apply && applyErr == nil {
-					if err := applyTags(uc.nexusConn, userInfo, wrong, missing, extra); err != nil {
-						applyErr = fmt.Errorf("Error applying tags to %s: %s", userInfo.User, err.Error())
-					}
-				}
-			}
-		} else {
-			if wrong, missing, extra, ok := checkTags(userInfo.Tags, uc.fullTags); !ok {
-				errOuts = append(errOuts, formatTagErrors(wrong, missing, nil))
-				if opts.apply && applyErr == nil {
-					if err := applyTags(uc.nexusConn, userInfo, wrong, missing, nil); err != nil {
-						applyErr = fmt.Errorf("Error applying tags to %s: %s", userInfo.User, err.Error())
-					}
-				}
-			} else if len(extra) != 0 {
-				warnOuts = append(warnOuts, formatTagErrors(nil, nil, extra))
+	if uc.fullTags != nil {
+		wrong, missing, extra := checkTagsWithDeepEqual(getTagsOnly(userInfo.Tags), uc.fullTags)
+		wrong, missing, extra = opts.exemptTags(ur, KindTags, wrong, missing, extra)
+		wrong, missing, extra = uc.checkFindings(KindTags, wrong, missing, extra, formatTagErrors, opts, ur, outs)
+		mergePrefTagVals(setWrong, wrong)
+		mergePrefTagVals(set, missing)
+		mergePrefTagVals(del, extra)
+	}
+
+	// Check perms
+	if uc.fullPermissions != nil {
+		wrong, missing, extra := checkTagsAsPerms(getPermsOnly(userInfo.Tags), uc.fullPermissions)
+		wrong, missing, extra = opts.exemptTags(ur, KindPermissions, wrong, missing, extra)
+		wrong, missing, extra = uc.checkFindings(KindPermissions, wrong, missing, extra, formatPermErrors, opts, ur, outs)
+		mergePrefTagVals(setWrong, wrong)
+		mergePrefTagVals(set, missing)
+		mergePrefTagVals(del, extra)
+	}
+
+	// Check custom rules
+	rulesTemplates := uc.checkRules(userInfo, opts, ur, outs, setWrong, set, del)
+
+	fixTemplates := len(templatesFound[SeverityError]) != 0
+	if fixTemplates || len(rulesTemplates) != 0 {
+		templatesPlan = uc.templatesPlan(userInfo, allowExtra, fixTemplates, rulesTemplates, ur, opts)
+		ur.Plan = append(ur.Plan, templatesPlan...)
+	}
+	if fixTemplates {
+		templatesFound[SeverityError] = append(templatesFound[SeverityError], fmt.Sprintf("\t* Changes: %s", formatPlan(templatesPlan)))
+	}
+	if uc.fullTemplates != nil {
+		wantsDesc := "Wants exactly"
+		if allowExtra {
+			wantsDesc = "Wants in order"
+		}
+		for _, level := range severityLevels {
+			if len(templatesFound[level]) != 0 {
+				outs[level] = append([]string{fmt.Sprintf("\tWRONG TEMPLATES:\n\n\t* Has: %s\n\t* %s: %s\n%s\n", jsonValue(userInfo.Templates), wantsDesc, jsonValue(uc.fullTemplates), strings.Join(templatesFound[level], "\n"))}, outs[level]...)
 			}
 		}
 	}
 
-	// Check perms
-	if uc.Permissions != nil {
-		if opts.NoExtraPermissions || uc.NoExtraPermissions {
-			if wrong, missing, extra, ok := checkPermsExactMatch(userInfo.Tags, uc.fullPermissions); !ok {
-				errOuts = append(errOuts, formatPermErrors(wrong, missing, extra))
-				if opts.apply && applyErr == nil {
-					if err := applyTags(uc.nexusConn, userInfo, wrong, missing, extra); err != nil {
-						applyErr = fmt.Errorf("Error applying permissions to %s: %s", userInfo.User, err.Error())
-					}
+	opts.emitFindings(ur, emitted)
+	if len(set) != 0 || len(del) != 0 {
+		ur.Plan = append(ur.Plan, planTags(set, del)...)
+	}
+
+	if opts.apply && len(ur.Plan) != planned {
+		if accept, err := opts.confirm(ur, ur.Plan[planned:]); err != nil {
+			applyErrs = append(applyErrs, err)
+		} else if accept {
+			if len(templatesPlan) != 0 {
+				if err := applyTemplates(uc.nexusConn, userInfo, templatesPlan, opts); err != nil {
+					applyErrs = append(applyErrs, err)
 				}
 			}
-		} else {
-			if wrong, missing, extra, ok := checkPerms(userInfo.Tags, uc.fullPermissions); !ok {
-				errOuts = append(errOuts, formatPermErrors(wrong, missing, nil))
-				if opts.apply && applyErr == nil {
-					if err := applyTags(uc.nexusConn, userInfo, wrong, missing, nil); err != nil {
-						applyErr = fmt.Errorf("Error applying permissions to %s: %s", userInfo.User, err.Error())
-					}
+			if (len(set) != 0 || len(del) != 0) && (len(applyErrs) == 0 || opts.continueOnError()) {
+				if err := applyTags(uc.nexusConn, userInfo, setWrong, set, del, opts); err != nil {
+					applyErrs = append(applyErrs, err)
 				}
-			} else if len(extra) != 0 {
-				warnOuts = append(warnOuts, formatPermErrors(nil, nil, extra))
 			}
 		}
 	}
 
 	out := []string{}
-	if len(errOuts) != 0 {
-		out = append(out, fmt.Sprintf("%s check errors:\n\n%s", userInfo.User, strings.Join(errOuts, "\n")))
+	if opts.output() == OutputDiff {
+		if len(ur.Findings) != 0 {
+			out = append(out, formatUserDiff(ur))
+		}
+	} else {
+		for _, level := range severityLevels {
+			if len(outs[level]) != 0 {
+				out = append(out, opts.colorize(level, fmt.Sprintf("%s check %s:\n\n%s", userInfo.User, severityTitles[level], strings.Join(outs[level], "\n"))))
+			}
+		}
+	}
+	if opts.output() == OutputColor && len(ur.Applied) != 0 {
+		out = append(out, formatApplied(ur, true))
+	}
+	if len(ur.Skipped) != 0 {
+		out = append(out, opts.colorize(SeverityWarning, fmt.Sprintf("%s skipped changes: %s\n", userInfo.User, formatPlan(ur.Skipped))))
 	}
-	if len(warnOuts) != 0 {
-		out = append(out, fmt.Sprintf("%s check warnings:\n\n%s", userInfo.User, strings.Join(warnOuts, "\n")))
+	applyErr := errors.Join(applyErrs...)
+	if applyErr != nil {
+		ur.Error = applyErr.Error()
 	}
-	return len(errOuts) == 0, strings.Join(out, "\n"), applyErr
+	ok := len(outs[SeverityError]) == 0 && (!opts.failOnWarnings() || len(outs[SeverityWarning]) == 0) && len(ur.Skipped) == 0
+	return ok, strings.Join(out, "\n"), applyErr
 }
 
-func formatTagErrors(wrong, missing, extra map[string]map[string]interface{}) string {
-	ls := []string{}
-	if len(wrong) != 0 {
-		ls = append(ls, "\tWRONG TAGS:\n")
-		for prefix, tagval := range wrong {
-			ls = append(ls, fmt.Sprintf("\t* %s", prefix))
-			for tag, value := range tagval {
-				if jsval, err := json.Marshal(value); err == nil {
-					value = string(jsval)
-				}
-				ls = append(ls, fmt.Sprintf("\t\t- %s: wants %v has %v", tag, missing[prefix][tag], value))
-			}
+// checkFindings reports the findings of a kind grouped by severity and returns
+// the error level ones, which are the ones to apply.
+func (uc *UsersCheck) checkFindings(kind string, wrong, missing, extra T, format func(wrong, missing, extra map[string]map[string]interface{}) string, opts *CheckOpts, ur *UserReport, outs map[string][]string) (T, T, T) {
+	wants, pureMissing := splitMissing(wrong, missing)
+	byLevel := func(level string) (T, T, T) {
+		lwrong, lmissing, lextra := T{}, T{}, T{}
+		if uc.severity(opts, kind, CategoryWrong) == level {
+			lwrong = wrong
+			mergePrefTagVals(lmissing, wants)
 		}
-		ls = append(ls, "")
-	}
-	if len(missing) != 0 {
-		ls = append(ls, "\tMISSING TAGS:\n")
-		for prefix, tagval := range missing {
-			ls = append(ls, fmt.Sprintf("\t* %s", prefix))
-			for tag, value := range tagval {
-				if wrong[prefix] == nil || wrong[prefix][tag] == nil {
-					if jsval, err := json.Marshal(value); err == nil {
-						value = string(jsval)
-					}
-					ls = append(ls, fmt.Sprintf("\t\t- %s: wants %v", tag, value))
-				}
-			}
-			ls = append(ls, "")
+		if uc.severity(opts, kind, CategoryMissing) == level {
+			mergePrefTagVals(lmissing, pureMissing)
 		}
+		if uc.severity(opts, kind, CategoryExtra) == level {
+			lextra = extra
+		}
+		return lwrong, lmissing, lextra
 	}
-	if len(extra) != 0 {
-		ls = append(ls, "\tEXTRA TAGS:\n")
-		for prefix, tagval := range extra {
-			ls = append(ls, fmt.Sprintf("\t* %s", prefix))
-			for tag, value := range tagval {
-				if jsval, err := json.Marshal(value); err == nil {
-					value = string(jsval)
-				}
-				ls = append(ls, fmt.Sprintf("\t\t- %s: has %v", tag, value))
-			}
-			ls = append(ls, "")
+	for _, level := range severityLevels {
+		lwrong, lmissing, lextra := byLevel(level)
+		if len(lmissing) != 0 || len(lextra) != 0 {
+			outs[level] = append(outs[level], format(lwrong, lmissing, lextra))
+			ur.addFindings(kind, level, lwrong, lmissing, lextra)
 		}
 	}
-	return strings.Join(ls, "\n")
+	return byLevel(SeverityError)
+}
+
+func formatTagErrors(wrong, missing, extra map[string]map[string]interface{}) string {
+	return formatTagFindings("TAGS", wrong, missing, extra, jsonValue)
 }
 
 func formatPermErrors(wrong, missing, extra map[string]map[string]interface{}) string {
+	return formatTagFindings("PERMISSIONS", wrong, missing, extra, func(value interface{}) string {
+		return jsonValue(ei.N(value).BoolZ())
+	})
+}
+
+func formatTagFindings(title string, wrong, missing, extra map[string]map[string]interface{}, format func(value interface{}) string) string {
 	ls := []string{}
 	if len(wrong) != 0 {
-		ls = append(ls, "\tWRONG PERMISSIONS:\n")
-		for prefix, tagval := range wrong {
+		ls = append(ls, fmt.Sprintf("\tWRONG %s:\n", title))
+		for _, prefix := range sortedKeys(wrong) {
 			ls = append(ls, fmt.Sprintf("\t* %s", prefix))
-			for tag, value := range tagval {
-				ls = append(ls, fmt.Sprintf("\t\t- %s: wants %v has %v", tag, ei.N(missing[prefix][tag]).BoolZ(), ei.N(value).BoolZ()))
+			for _, tag := range sortedKeys(wrong[prefix]) {
+				ls = append(ls, fmt.Sprintf("\t\t- %s: wants %s has %s", tag, format(missing[prefix][tag]), format(wrong[prefix][tag])))
 			}
 			ls = append(ls, "")
 		}
 	}
-	if len(missing) != 0 {
-		ls = append(ls, "\tMISSING PERMISSIONS:\n")
-		for prefix, tagval := range missing {
+	if _, pure := splitMissing(wrong, missing); len(pure) != 0 {
+		ls = append(ls, fmt.Sprintf("\tMISSING %s:\n", title))
+		for _, prefix := range sortedKeys(pure) {
 			ls = append(ls, fmt.Sprintf("\t* %s", prefix))
-			for tag, value := range tagval {
-				if wrong[prefix] == nil || wrong[prefix][tag] == nil {
-					ls = append(ls, fmt.Sprintf("\t\t- %s: wants %v", tag, ei.N(value).BoolZ()))
-				}
+			for _, tag := range sortedKeys(pure[prefix]) {
+				ls = append(ls, fmt.Sprintf("\t\t- %s: wants %s", tag, format(pure[prefix][tag])))
 			}
 			ls = append(ls, "")
 		}
 	}
 	if len(extra) != 0 {
-		ls = append(ls, "\tEXTRA PERMISSIONS:\n")
-		for prefix, tagval := range extra {
+		ls = append(ls, fmt.Sprintf("\tEXTRA %s:\n", title))
+		for _, prefix := range sortedKeys(extra) {
 			ls = append(ls, fmt.Sprintf("\t* %s", prefix))
-			for tag, value := range tagval {
-				ls = append(ls, fmt.Sprintf("\t\t- %s: has %v", tag, ei.N(value).BoolZ()))
+			for _, tag := range sortedKeys(extra[prefix]) {
+				ls = append(ls, fmt.Sprintf("\t\t- %s: has %s", tag, format(extra[prefix][tag])))
 			}
 			ls = append(ls, "")
 		}
@@ -489,51 +811,151 @@ func formatPermErrors(wrong, missing, extra map[string]map[string]interface{}) s
 	return strings.Join(ls, "\n")
 }
 
-func applyTemplates(nc *nx.NexusConn, userInfo *nx.UserInfo, templates []string) error {
-	for _, tpl := range userInfo.Templates {
-		if _, err := nc.UserDelTemplate(userInfo.User, tpl); err != nil {
-			return err
+func applyTemplates(nc *nx.NexusConn, userInfo *nx.UserInfo, plan []*PlanOp, opts *CheckOpts) error {
+	errs := []error{}
+	// Templates the user has after the changes applied so far
+	expected := append([]string{}, userInfo.Templates...)
+	for _, op := range plan {
+		if !opts.beforeApply(userInfo.User, op) {
+			continue
+		}
+		var err error
+		switch op.Op {
+		case AuditDelTemplate:
+			err = opts.retry(userInfo.User, func() error {
+				_, err := nc.UserDelTemplate(userInfo.User, op.Key)
+				return err
+			})
+			if err == nil {
+				kept := []string{}
+				for _, tpl := range expected {
+					if tpl != op.Key {
+						kept = append(kept, tpl)
+					}
+				}
+				expected = kept
+			}
+			if auditErr := opts.audit(userInfo.User, AuditDelTemplate, "", op.Key, op.Key, nil, err); err == nil {
+				err = auditErr
+			}
+		case AuditAddTemplate:
+			added := append(append([]string{}, expected...), op.Key)
+			attempts := 0
+			err = opts.retry(userInfo.User, func() error {
+				attempts++
+				// Adding appends again, so a retried add checks whether a timed
+				// out attempt succeeded
+				if attempts > 1 {
+					tpls, err := userTemplates(nc, userInfo.User)
+					if err != nil {
+						return err
+					}
+					if checkTemplatesExactMatch(tpls, added) {
+						return nil
+					}
+				}
+				_, err := nc.UserAddTemplate(userInfo.User, op.Key)
+				return err
+			})
+			if err == nil {
+				expected = added
+			}
+			if auditErr := opts.audit(userInfo.User, AuditAddTemplate, "", op.Key, nil, op.Key, err); err == nil {
+				err = auditErr
+			}
+		}
+		if err != nil {
+			err = &ApplyError{User: userInfo.User, Op: op.Op, Key: op.Key, Err: err}
+			if !opts.continueOnError() {
+				return err
+			}
+			errs = append(errs, err)
 		}
 	}
-	for _, tpl := range templates {
-		if _, err := nc.UserAddTemplate(userInfo.User, tpl); err != nil {
-			return err
+	return errors.Join(errs...)
+}
+
+func userTemplates(nc *nx.NexusConn, user string) ([]string, error) {
+	users, err := nc.UserList(user, 0, 0, &nx.ListOpts{LimitByDepth: true, Depth: 0})
+	if err != nil {
+		return nil, err
+	}
+	for _, u := range users {
+		if u.User == user {
+			return u.Templates, nil
 		}
 	}
-	return nil
+	return nil, fmt.Errorf("user %s not found", user)
 }
 
-func applyTags(nc *nx.NexusConn, userInfo *nx.UserInfo, wrong map[string]map[string]interface{}, missing map[string]map[string]interface{}, extra map[string]map[string]interface{}) error {
-	if wrong != nil {
-		for prefix, tagval := range wrong {
-			delTags := []string{}
-			for tag := range tagval {
-				delTags = append(delTags, tag)
+// applyTags overwrites wrong values in place and adds missing ones with a
+// single call per prefix, and only then deletes the genuine extras with one
+// call per prefix. Grants come before revocations and no key being changed is
+// ever absent.
+func applyTags(nc *nx.NexusConn, userInfo *nx.UserInfo, wrong map[string]map[string]interface{}, set map[string]map[string]interface{}, del map[string]map[string]interface{}, opts *CheckOpts) error {
+	errs := []error{}
+	for _, prefix := range sortedKeys(set) {
+		tagval := opts.allowedTags(userInfo.User, AuditSetTag, prefix, set[prefix])
+		keys := sortedKeys(tagval)
+		if len(keys) == 0 {
+			continue
+		}
+		err := opts.retry(userInfo.User, func() error {
+			_, err := nc.UserSetTags(userInfo.User, prefix, tagval)
+			return err
+		})
+		for _, tag := range keys {
+			if auditErr := opts.audit(userInfo.User, AuditSetTag, prefix, tag, wrong[prefix][tag], tagval[tag], err); err == nil {
+				err = auditErr
 			}
-			if _, err := nc.UserDelTags(userInfo.User, prefix, delTags); err != nil {
+		}
+		if err != nil {
+			err = &ApplyError{User: userInfo.User, Op: AuditSetTag, Prefix: prefix, Key: strings.Join(keys, ","), Err: err}
+			if !opts.continueOnError() {
 				return err
 			}
+			errs = append(errs, err)
 		}
 	}
-	if extra != nil {
-		for prefix, tagval := range extra {
-			delTags := []string{}
-			for tag := range tagval {
-				delTags = append(delTags, tag)
+	for _, prefix := range sortedKeys(del) {
+		tagval := opts.allowedTags(userInfo.User, AuditDelTag, prefix, del[prefix])
+		keys := sortedKeys(tagval)
+		if len(keys) == 0 {
+			continue
+		}
+		err := opts.retry(userInfo.User, func() error {
+			_, err := nc.UserDelTags(userInfo.User, prefix, keys)
+			return err
+		})
+		for _, tag := range keys {
+			if auditErr := opts.audit(userInfo.User, AuditDelTag, prefix, tag, tagval[tag], nil, err); err == nil {
+				err = auditErr
 			}
-			if _, err := nc.UserDelTags(userInfo.User, prefix, delTags); err != nil {
+		}
+		if err != nil {
+			err = &ApplyError{User: userInfo.User, Op: AuditDelTag, Prefix: prefix, Key: strings.Join(keys, ","), Err: err}
+			if !opts.continueOnError() {
 				return err
 			}
+			errs = append(errs, err)
 		}
 	}
-	if missing != nil {
-		for prefix, tagval := range missing {
-			if _, err := nc.UserSetTags(userInfo.User, prefix, tagval); err != nil {
-				return err
-			}
+	return errors.Join(errs...)
+}
+
+func planTags(set map[string]map[string]interface{}, del map[string]map[string]interface{}) []*PlanOp {
+	plan := []*PlanOp{}
+	for _, prefix := range sortedKeys(set) {
+		for _, tag := range sortedKeys(set[prefix]) {
+			plan = append(plan, &PlanOp{Op: AuditSetTag, Prefix: prefix, Key: tag, Value: set[prefix][tag]})
 		}
 	}
-	return nil
+	for _, prefix := range sortedKeys(del) {
+		for _, tag := range sortedKeys(del[prefix]) {
+			plan = append(plan, &PlanOp{Op: AuditDelTag, Prefix: prefix, Key: tag})
+		}
+	}
+	return plan
 }
 
 func checkTemplatesExactMatch(has []string, wants []string) bool {
@@ -551,7 +973,7 @@ func checkTemplatesExactMatch(has []string, wants []string) bool {
 func checkTemplatesOrderMatch(has []string, wants []string) ([]string, bool) {
 	i := 0
 	for _, tpl := range has {
-		if wants[i] == tpl {
+		if i < len(wants) && wants[i] == tpl {
 			i++
 		}
 	}
@@ -580,30 +1002,6 @@ func checkTemplatesAnyOrder(has []string, wants []string) ([]string, bool) {
 	return nil, true
 }
 
-func checkTagsExactMatch(has map[string]map[string]interface{}, wants map[string]map[string]interface{}) (map[string]map[string]interface{}, map[string]map[string]interface{}, map[string]map[string]interface{}, bool) {
-	hasTags := getTagsOnly(has)
-	wrong, missing, extra := checkTagsWithDeepEqual(hasTags, wants)
-	return wrong, missing, extra, (len(missing) == 0 && len(extra) == 0)
-}
-
-func checkTags(has map[string]map[string]interface{}, wants map[string]map[string]interface{}) (map[string]map[string]interface{}, map[string]map[string]interface{}, map[string]map[string]interface{}, bool) {
-	hasTags := getTagsOnly(has)
-	wrong, missing, extra := checkTagsWithDeepEqual(hasTags, wants)
-	return wrong, missing, extra, len(missing) == 0
-}
-
-func checkPermsExactMatch(has map[string]map[string]interface{}, wants map[string]map[string]interface{}) (map[string]map[string]interface{}, map[string]map[string]interface{}, map[string]map[string]interface{}, bool) {
-	hasPerms := getPermsOnly(has)
-	wrong, missing, extra := checkTagsAsPerms(hasPerms, wants)
-	return wrong, missing, extra, (len(missing) == 0 && len(extra) == 0)
-}
-
-func checkPerms(has map[string]map[string]interface{}, wants map[string]map[string]interface{}) (map[string]map[string]interface{}, map[string]map[string]interface{}, map[string]map[string]interface{}, bool) {
-	hasPerms := getPermsOnly(has)
-	wrong, missing, extra := checkTagsAsPerms(hasPerms, wants)
-	return wrong, missing, extra, len(missing) == 0
-}
-
 func checkTagsAsPerms(has map[string]map[string]interface{}, wants map[string]map[string]interface{}) (map[string]map[string]interface{}, map[string]map[string]interface{}, map[string]map[string]interface{}) {
 	return checkTagsWithFunc(has, wants, func(hval interface{}, wval interface{}) bool {
 		return ei.N(hval).BoolZ() == ei.N(wval).BoolZ()
@@ -646,6 +1044,29 @@ func checkTagsWithFunc(has map[string]map[string]interface{}, wants map[string]m
 	return wrong, missing, extra
 }
 
+func splitMissing(wrong, missing map[string]map[string]interface{}) (map[string]map[string]interface{}, map[string]map[string]interface{}) {
+	wants := map[string]map[string]interface{}{}
+	pure := map[string]map[string]interface{}{}
+	for prefix, tagval := range missing {
+		for tag, value := range tagval {
+			if _, ok := wrong[prefix][tag]; ok {
+				addPrefTagVal(wants, prefix, tag, value)
+			} else {
+				addPrefTagVal(pure, prefix, tag, value)
+			}
+		}
+	}
+	return wants, pure
+}
+
+func mergePrefTagVals(dest map[string]map[string]interface{}, src map[string]map[string]interface{}) {
+	for prefix, tagval := range src {
+		for tag, value := range tagval {
+			addPrefTagVal(dest, prefix, tag, value)
+		}
+	}
+}
+
 func getTagsOnly(tags map[string]map[string]interface{}) map[string]map[string]interface{} {
 	tagsOnly := map[string]map[string]interface{}{}
 	for prefix, tagval := range tags {
@@ -677,6 +1098,10 @@ func addPrefTagVal(dest map[string]map[string]interface{}, prefix string, tag st
 	if _, ok := dest[prefix]; !ok {
 		dest[prefix] = map[string]interface{}{}
 	}
+	dest[prefix][tag] = normalizeValue(val)
+}
+
+func normalizeValue(val interface{}) interface{} {
 	sval, err := json.Marshal(val)
 	if err != nil {
 		panic(err.Error())
@@ -684,16 +1109,5 @@ func addPrefTagVal(dest map[string]map[string]interface{}, prefix string, tag st
 	if err = json.Unmarshal(sval, &val); err != nil {
 		panic(err.Error())
 	}
-
-	dest[prefix][tag] = val
-}
-
-func addPrefPermVal(dest map[string]map[string]interface{}, prefix string, perm string, val bool) {
-	if dest == nil {
-		dest = map[string]map[string]interface{}{}
-	}
-	if _, ok := dest[prefix]; !ok {
-		dest[prefix] = map[string]interface{}{}
-	}
-	dest[prefix][perm] = val
+	return val
 }
@@ -0,0 +1,91 @@
+package nxusercheck
+
+// Observer is notified as a run goes: when a check starts and ends, for every
+// user checked, every finding and every change before and after applying it.
+// A non nil error from BeforeApply vetoes the change, which is reported as
+// skipped. Embed BaseObserver to implement only some of the callbacks.
+type Observer interface {
+	OnCheckStart(check *UsersCheck)
+	OnUser(check *UsersCheck, user string)
+	OnFinding(check *UsersCheck, user string, finding *Finding)
+	BeforeApply(check *UsersCheck, user string, op *PlanOp) error
+	AfterApply(check *UsersCheck, rec *AuditRecord)
+	OnCheckDone(check *UsersCheck, report *CheckReport)
+}
+
+type BaseObserver struct{}
+
+func (BaseObserver) OnCheckStart(check *UsersCheck)                               {}
+func (BaseObserver) OnUser(check *UsersCheck, user string)                        {}
+func (BaseObserver) OnFinding(check *UsersCheck, user string, finding *Finding)   {}
+func (BaseObserver) BeforeApply(check *UsersCheck, user string, op *PlanOp) error { return nil }
+func (BaseObserver) AfterApply(check *UsersCheck, rec *AuditRecord)               {}
+func (BaseObserver) OnCheckDone(check *UsersCheck, report *CheckReport)           {}
+
+func (opts *CheckOpts) startCheck(check *UsersCheck) {
+	opts.check = check
+	opts.acceptAll = false
+	opts.checkReport = opts.report.addCheck(check)
+	opts.checkReport.Environment = opts.environment
+	opts.checkReport.Opts = check.effectiveOpts(opts)
+	if opts.Observer != nil {
+		opts.Observer.OnCheckStart(check)
+	}
+}
+
+func (opts *CheckOpts) doneCheck(err error) {
+	opts.checkReport.setError(err)
+	if opts.Observer != nil {
+		opts.Observer.OnCheckDone(opts.check, opts.checkReport)
+	}
+}
+
+func (opts *CheckOpts) onUser(user string) {
+	if opts.Observer != nil {
+		opts.Observer.OnUser(opts.check, user)
+	}
+}
+
+// emitFindings notifies the findings of a user from the index from on and
+// returns the index of the next one.
+func (opts *CheckOpts) emitFindings(ur *UserReport, from int) int {
+	if opts.Observer != nil {
+		for _, f := range ur.Findings[from:] {
+			opts.Observer.OnFinding(opts.check, ur.User, f)
+		}
+	}
+	return len(ur.Findings)
+}
+
+// beforeApply returns whether a change can be applied, reporting it as
+// skipped otherwise.
+func (opts *CheckOpts) beforeApply(user string, op *PlanOp) bool {
+	if opts.Observer == nil {
+		return true
+	}
+	if err := opts.Observer.BeforeApply(opts.check, user, op); err != nil {
+		skipped := *op
+		skipped.Reason = err.Error()
+		ur := opts.userReport(user)
+		ur.Skipped = append(ur.Skipped, &skipped)
+		return false
+	}
+	return true
+}
+
+func (opts *CheckOpts) allowedTags(user string, op string, prefix string, tagval map[string]interface{}) map[string]interface{} {
+	if opts.Observer == nil {
+		return tagval
+	}
+	allowed := map[string]interface{}{}
+	for _, tag := range sortedKeys(tagval) {
+		planOp := &PlanOp{Op: op, Prefix: prefix, Key: tag}
+		if op == AuditSetTag {
+			planOp.Value = tagval[tag]
+		}
+		if opts.beforeApply(user, planOp) {
+			allowed[tag] = tagval[tag]
+		}
+	}
+	return allowed
+}
@@ -0,0 +1,152 @@
+package nxusercheck
+
+import (
+	"fmt"
+)
+
+// Options are layered from lowest to highest precedence: defaults, file opts,
+// per check settings and the opts passed by the caller. Unset (nil) booleans
+// fall through to the layer below, so a check can turn off a global
+// noExtraTags and the caller can still force it on or off for every check.
+
+// EffectiveOpts are the options a check was run with after layering.
+type EffectiveOpts struct {
+	AllowExtraTemplates bool       `json:"allowExtraTemplates"`
+	NoExtraPermissions  bool       `json:"noExtraPermissions"`
+	NoExtraTags         bool       `json:"noExtraTags"`
+	CreateMissing       bool       `json:"createMissing"`
+	Severity            Severities `json:"severity"`
+}
+
+func Bool(v bool) *bool {
+	return &v
+}
+
+func boolOpt(layers ...*bool) bool {
+	v := false
+	for _, layer := range layers {
+		if layer != nil {
+			v = *layer
+		}
+	}
+	return v
+}
+
+// layerOpts returns the caller opts on top of the file ones.
+func layerOpts(file *CheckOpts, caller *CheckOpts) *CheckOpts {
+	opt := *caller
+	if file == nil {
+		return &opt
+	}
+	fileOpt := *file
+	opt.file = &fileOpt
+	if opt.AuditLog == "" {
+		opt.AuditLog = file.AuditLog
+	}
+	if opt.Audit == nil {
+		opt.Audit = file.Audit
+	}
+	if opt.AuditActor == "" {
+		opt.AuditActor = file.AuditActor
+	}
+	if opt.Output == "" {
+		opt.Output = file.Output
+	}
+	if opt.Template == "" && opt.TemplateFile == "" {
+		opt.Template, opt.TemplateFile = file.Template, file.TemplateFile
+	}
+	if opt.MetricsFile == "" {
+		opt.MetricsFile = file.MetricsFile
+	}
+	if opt.Metrics == nil {
+		opt.Metrics = file.Metrics
+	}
+	if opt.Observer == nil {
+		opt.Observer = file.Observer
+	}
+	if opt.Confirm == nil {
+		opt.Confirm = file.Confirm
+	}
+	if len(file.Roles) != 0 {
+		roles := map[string]*Role{}
+		for name, role := range file.Roles {
+			roles[name] = role
+		}
+		for name, role := range caller.Roles {
+			roles[name] = role
+		}
+		opt.Roles = roles
+	}
+	opt.Exemptions = append(append([]*Exemption{}, file.Exemptions...), caller.Exemptions...)
+	opt.ExprRules = append(append([]*ExprRule{}, file.ExprRules...), caller.ExprRules...)
+	return &opt
+}
+
+func (opts *CheckOpts) fileOpts() *CheckOpts {
+	if opts.file == nil {
+		return &CheckOpts{}
+	}
+	return opts.file
+}
+
+func (opts *CheckOpts) failOnWarnings() bool {
+	return boolOpt(opts.fileOpts().FailOnWarnings, opts.FailOnWarnings)
+}
+
+func (opts *CheckOpts) validate() error {
+	if err := opts.fileOpts().Severity.validate(); err != nil {
+		return err
+	}
+	if output := opts.output(); !containsString(outputs, output) {
+		return fmt.Errorf("invalid output %s", output)
+	}
+	if text, err := opts.template(); err != nil {
+		return err
+	} else if _, err = parseReportTemplate(text); err != nil {
+		return err
+	}
+	return opts.Severity.validate()
+}
+
+func (opts *CheckOpts) output() string {
+	if opts.Output != "" {
+		return opts.Output
+	}
+	if output := opts.fileOpts().Output; output != "" {
+		return output
+	}
+	return OutputText
+}
+
+func (uc *UsersCheck) allowExtraTemplates(opts *CheckOpts) bool {
+	return boolOpt(opts.fileOpts().AllowExtraTemplates, uc.AllowExtraTemplates, opts.AllowExtraTemplates)
+}
+
+func (uc *UsersCheck) noExtraPermissions(opts *CheckOpts) bool {
+	return boolOpt(opts.fileOpts().NoExtraPermissions, uc.NoExtraPermissions, opts.NoExtraPermissions)
+}
+
+func (uc *UsersCheck) noExtraTags(opts *CheckOpts) bool {
+	return boolOpt(opts.fileOpts().NoExtraTags, uc.NoExtraTags, opts.NoExtraTags)
+}
+
+func (uc *UsersCheck) createMissing(opts *CheckOpts) bool {
+	return boolOpt(opts.fileOpts().CreateMissing, uc.CreateMissing, opts.CreateMissing)
+}
+
+func (uc *UsersCheck) effectiveOpts(opts *CheckOpts) *EffectiveOpts {
+	eo := &EffectiveOpts{
+		AllowExtraTemplates: uc.allowExtraTemplates(opts),
+		NoExtraPermissions:  uc.noExtraPermissions(opts),
+		NoExtraTags:         uc.noExtraTags(opts),
+		CreateMissing:       uc.createMissing(opts),
+		Severity:            Severities{},
+	}
+	for _, kind := range []string{KindTemplates, KindTags, KindPermissions} {
+		eo.Severity[kind] = map[string]string{}
+		for _, category := range []string{CategoryWrong, CategoryMissing, CategoryExtra} {
+			eo.Severity[kind][category] = uc.severity(opts, kind, category)
+		}
+	}
+	return eo
+}
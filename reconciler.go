@@ -0,0 +1,364 @@
+package nxusercheck
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	nx "github.com/nayarsystems/nxgo/nxcore"
+)
+
+// Reconciler keeps checking (and optionally applying) a config file, or one of
+// its environments, against nexus. It reloads the config when any of its files
+// change, reconnects with backoff when the connection drops and can expose its
+// state over http.
+type Reconciler struct {
+	File         string
+	Environment  string
+	Interval     time.Duration
+	Schedule     string
+	AutoApply    bool
+	Listen       string
+	ConfigPoll   time.Duration
+	ReconnectMin time.Duration
+	ReconnectMax time.Duration
+	Metrics      *Metrics
+	Audit        AuditSink
+	Opts         *CheckOpts
+
+	mu          sync.Mutex
+	running     bool
+	nc          *nx.NexusConn
+	ncLogin     [3]string
+	backoff     time.Duration
+	schedule    *cronSchedule
+	fingerprint string
+	config      *userChecksFromFile
+	configErr   error
+	last        *ReconcilerStatus
+}
+
+type ReconcilerStatus struct {
+	Time   time.Time `json:"time"`
+	Apply  bool      `json:"apply"`
+	Output string    `json:"output"`
+	Error  string    `json:"error,omitempty"`
+	Report *Report   `json:"report,omitempty"`
+}
+
+func NewReconciler(file string) *Reconciler {
+	return &Reconciler{
+		File:         file,
+		Interval:     5 * time.Minute,
+		ConfigPoll:   10 * time.Second,
+		ReconnectMin: time.Second,
+		ReconnectMax: time.Minute,
+	}
+}
+
+func (r *Reconciler) Run(ctx context.Context) error {
+	if r.Schedule != "" {
+		schedule, err := parseCron(r.Schedule)
+		if err != nil {
+			return err
+		}
+		r.schedule = schedule
+	} else if r.Interval <= 0 {
+		return fmt.Errorf("Error starting reconciler: no interval or schedule")
+	}
+
+	if r.Listen != "" {
+		ln, err := net.Listen("tcp", r.Listen)
+		if err != nil {
+			return fmt.Errorf("Error starting reconciler: %s", err.Error())
+		}
+		srv := &http.Server{Handler: r}
+		go func() {
+			<-ctx.Done()
+			srv.Close()
+		}()
+		go srv.Serve(ln)
+	}
+
+	r.setRunning(true)
+	defer r.setRunning(false)
+	defer r.disconnect()
+
+	r.reload()
+	poll := time.NewTicker(r.ConfigPoll)
+	defer poll.Stop()
+	next := time.Now()
+	for {
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-poll.C:
+			timer.Stop()
+			if r.configChanged() {
+				r.reload()
+				next = time.Now()
+			}
+		case <-timer.C:
+			now := time.Now()
+			next = r.nextRun(now)
+			if !r.runOnce() {
+				// Failed connections are retried with backoff until the next run
+				if retry := now.Add(r.nextBackoff()); retry.Before(next) {
+					next = retry
+				}
+			}
+		}
+	}
+}
+
+func (r *Reconciler) nextRun(now time.Time) time.Time {
+	if r.schedule != nil {
+		if next := r.schedule.Next(now); !next.IsZero() {
+			return next
+		}
+		return now.AddDate(100, 0, 0)
+	}
+	return now.Add(r.Interval)
+}
+
+// nextBackoff returns the time to wait before retrying a failed connection,
+// doubling it on each failure from ReconnectMin to ReconnectMax.
+func (r *Reconciler) nextBackoff() time.Duration {
+	if r.backoff *= 2; r.backoff < r.ReconnectMin {
+		r.backoff = r.ReconnectMin
+	}
+	if r.backoff > r.ReconnectMax {
+		r.backoff = r.ReconnectMax
+	}
+	return r.backoff
+}
+
+// runOnce runs the checks once, returning false when it couldn't connect to
+// nexus.
+func (r *Reconciler) runOnce() bool {
+	r.mu.Lock()
+	config, configErr := r.config, r.configErr
+	r.mu.Unlock()
+
+	status := &ReconcilerStatus{Time: time.Now(), Apply: r.AutoApply}
+	defer r.setStatus(status)
+
+	overrides := CheckOpts{}
+	if r.Opts != nil {
+		overrides = *r.Opts
+	}
+	if r.Metrics != nil {
+		overrides.Metrics = r.Metrics
+	}
+	if r.Audit != nil {
+		overrides.Audit = r.Audit
+	}
+	// Invalid configs and connection errors are observed as failed runs
+	fail := func(err error) {
+		status.Output, status.Error = err.Error(), err.Error()
+		overrides.report = newReport(r.AutoApply)
+		overrides.report.Error = err.Error()
+		overrides.observeReport()
+		status.Report = overrides.report
+	}
+	var target *environmentTarget
+	if configErr == nil {
+		target, configErr = r.target(config)
+	}
+	if configErr != nil {
+		fail(configErr)
+		return true
+	}
+	nc, err := r.connect(target)
+	if err != nil {
+		fail(err)
+		return false
+	}
+	r.backoff = 0
+	opt := layerOpts(target.opts, &overrides)
+	opt.environment = target.name
+	report, out, err := runNexusConn(r.AutoApply, target.checks, nc, opt)
+	status.Report, status.Output = report, out
+	if err != nil {
+		status.Error = err.Error()
+	}
+	return true
+}
+
+// target returns the checks, opts and nexus settings of the config, or of the
+// reconciler environment when set.
+func (r *Reconciler) target(config *userChecksFromFile) (*environmentTarget, error) {
+	fileOpt := *config.fileOpts()
+	if r.Environment == "" {
+		fileOpt.AuditActor = config.NexusUser
+		return &environmentTarget{checks: config.defaultChecks(), opts: &fileOpt, nexusHost: config.NexusHost, nexusUser: config.NexusUser, nexusPass: config.NexusPass}, nil
+	}
+	if r.Environment == AllEnvironments {
+		return nil, fmt.Errorf("Error selecting environments: the reconciler runs a single environment")
+	}
+	if _, err := config.environmentNames([]string{r.Environment}); err != nil {
+		return nil, err
+	}
+	target, err := config.environment(r.Environment, &fileOpt)
+	if err != nil {
+		return nil, err
+	}
+	opt := *target.opts
+	opt.AuditActor = target.nexusUser
+	target.opts = &opt
+	return target, nil
+}
+
+// connect reuses the open connection while it answers and was opened with the
+// login of the target, or tries to open a new one.
+func (r *Reconciler) connect(target *environmentTarget) (*nx.NexusConn, error) {
+	login := [3]string{target.nexusHost, target.nexusUser, target.nexusPass}
+	r.mu.Lock()
+	nc := r.nc
+	if nc != nil && r.ncLogin != login {
+		nc = nil
+	}
+	r.mu.Unlock()
+	if nc != nil {
+		if err := nc.Ping(10 * time.Second); err == nil {
+			return nc, nil
+		}
+	}
+	r.disconnect()
+
+	nc, err := getNexusConn(target.nexusHost, target.nexusUser, target.nexusPass)
+	if err != nil {
+		return nil, fmt.Errorf("Error connecting to %s: %s", target.nexusHost, err.Error())
+	}
+	r.mu.Lock()
+	r.nc, r.ncLogin = nc, login
+	r.mu.Unlock()
+	return nc, nil
+}
+
+func (r *Reconciler) disconnect() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.nc != nil {
+		r.nc.Close()
+		r.nc = nil
+	}
+}
+
+// reload loads the config again, closing the connection when the nexus host or
+// login of the target changed.
+func (r *Reconciler) reload() {
+	ucff, files, err := loadConfigFiles(r.File)
+	if err == nil && ucff.Opts == nil {
+		ucff.Opts = &CheckOpts{}
+	}
+	var target *environmentTarget
+	if err == nil {
+		target, _ = r.target(ucff)
+	}
+	r.mu.Lock()
+	r.fingerprint = configFingerprint(r.File, files)
+	r.config, r.configErr = ucff, err
+	changed := target == nil || r.ncLogin != [3]string{target.nexusHost, target.nexusUser, target.nexusPass}
+	r.mu.Unlock()
+	if changed {
+		r.disconnect()
+	}
+}
+
+func (r *Reconciler) configChanged() bool {
+	_, files, _ := loadConfigFiles(r.File)
+	fingerprint := configFingerprint(r.File, files)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return fingerprint != r.fingerprint
+}
+
+func configFingerprint(file string, files []string) string {
+	files = append([]string{file}, files...)
+	sort.Strings(files)
+	ls := []string{}
+	for _, f := range files {
+		if fi, err := os.Stat(f); err == nil {
+			ls = append(ls, fmt.Sprintf("%s:%d:%d", f, fi.Size(), fi.ModTime().UnixNano()))
+		} else {
+			ls = append(ls, f+":-")
+		}
+	}
+	return strings.Join(ls, "\n")
+}
+
+func (r *Reconciler) setRunning(running bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.running = running
+}
+
+func (r *Reconciler) setStatus(status *ReconcilerStatus) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.last = status
+}
+
+func (r *Reconciler) LastStatus() *ReconcilerStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.last
+}
+
+func (r *Reconciler) ready() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.configErr != nil {
+		return r.configErr
+	}
+	if r.nc == nil {
+		return fmt.Errorf("not connected to nexus")
+	}
+	return nil
+}
+
+func (r *Reconciler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	switch req.URL.Path {
+	case "/healthz":
+		r.mu.Lock()
+		running := r.running
+		r.mu.Unlock()
+		if !running {
+			http.Error(w, "not running", http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	case "/readyz":
+		if err := r.ready(); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	case "/report":
+		status := r.LastStatus()
+		if status == nil {
+			http.Error(w, "no report yet", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(status)
+	case "/metrics":
+		if r.Metrics == nil {
+			http.NotFound(w, req)
+			return
+		}
+		r.Metrics.ServeHTTP(w, req)
+	default:
+		http.NotFound(w, req)
+	}
+}
@@ -0,0 +1,372 @@
+package nxusercheck
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"sort"
+	"strings"
+)
+
+const (
+	OutputText     = "text"
+	OutputDiff     = "diff"
+	OutputColor    = "color"
+	OutputMarkdown = "markdown"
+	OutputHTML     = "html"
+)
+
+var outputs = []string{OutputText, OutputDiff, OutputColor, OutputMarkdown, OutputHTML}
+
+const (
+	ansiRed    = "\x1b[31m"
+	ansiYellow = "\x1b[33m"
+	ansiGreen  = "\x1b[32m"
+	ansiReset  = "\x1b[0m"
+)
+
+var severityColors = map[string]string{
+	SeverityError:   ansiRed,
+	SeverityWarning: ansiYellow,
+}
+
+var kindOrder = map[string]int{KindUsers: -1, KindTemplates: 0, KindTags: 1, KindPermissions: 2, KindRules: 3}
+
+func jsonValue(value interface{}) string {
+	if jsval, err := json.Marshal(value); err == nil {
+		return string(jsval)
+	}
+	return fmt.Sprintf("%v", value)
+}
+
+// formatUserDiff renders the findings of a user as a unified diff from what
+// the user has (-) to what the checks want (+). Findings that are not errors
+// are marked with their severity.
+func formatUserDiff(ur *UserReport) string {
+	findings := append([]*Finding{}, ur.Findings...)
+	sort.SliceStable(findings, func(i, j int) bool {
+		a, b := findings[i], findings[j]
+		if a.Kind != b.Kind {
+			return kindOrder[a.Kind] < kindOrder[b.Kind]
+		}
+		if a.Prefix != b.Prefix {
+			return a.Prefix < b.Prefix
+		}
+		return a.Key < b.Key
+	})
+	ls := []string{fmt.Sprintf("--- %s has", ur.User), fmt.Sprintf("+++ %s wants", ur.User)}
+	hunk := ""
+	for _, f := range findings {
+		h := f.Kind
+		if f.Prefix != "" {
+			h += " " + f.Prefix
+		}
+		if h != hunk {
+			ls = append(ls, fmt.Sprintf("@@ %s @@", h))
+			hunk = h
+		}
+		mark := ""
+		if f.Severity != SeverityError {
+			mark = "  # " + f.Severity
+		}
+		has, wants := jsonValue(f.Has), jsonValue(f.Wants)
+		switch {
+		case f.Kind == KindTemplates && f.Key != "", f.Kind == KindUsers:
+			has, wants = jsonValue(f.Key), jsonValue(f.Key)
+		case f.Kind == KindRules:
+			label := strings.TrimSpace(f.Rule + " " + f.Key)
+			if f.Has == nil && f.Wants == nil {
+				has, wants = label, label
+			} else {
+				has, wants = label+": "+has, label+": "+wants
+			}
+			if f.Message != "" {
+				mark += "  # " + f.Message
+			}
+		case f.Key != "":
+			has, wants = f.Key+": "+has, f.Key+": "+wants
+		}
+		if f.Category != CategoryMissing {
+			ls = append(ls, "-"+has+mark)
+		}
+		if f.Category != CategoryExtra {
+			ls = append(ls, "+"+wants+mark)
+		}
+	}
+	return strings.Join(ls, "\n") + "\n"
+}
+
+// RenderReport renders a report as text (the findings of each user), diff,
+// markdown or html.
+func RenderReport(report *Report, output string) (string, error) {
+	switch output {
+	case OutputText, OutputColor:
+		return formatReportText(report, output == OutputColor), nil
+	case OutputDiff:
+		ls := []string{}
+		for _, cr := range report.Checks {
+			for _, ur := range cr.Users {
+				if len(ur.Findings) != 0 {
+					ls = append(ls, formatUserDiff(ur))
+				}
+			}
+		}
+		return strings.Join(ls, "\n"), nil
+	case OutputMarkdown:
+		return formatReportMarkdown(report), nil
+	case OutputHTML:
+		return formatReportHTML(report)
+	}
+	return "", fmt.Errorf("Error rendering report: invalid output %s", output)
+}
+
+// render replaces the output of a run by the rendered report for the report
+// only outputs and templates.
+func (opts *CheckOpts) render(report *Report, out string) string {
+	if text, err := opts.template(); err != nil {
+		return err.Error()
+	} else if text != "" {
+		rendered, err := RenderTemplate(report, text)
+		if err != nil {
+			return err.Error()
+		}
+		return rendered
+	}
+	switch output := opts.output(); output {
+	case OutputMarkdown, OutputHTML:
+		if rendered, err := RenderReport(report, output); err == nil {
+			return rendered
+		}
+	}
+	return out
+}
+
+func colorize(color string, s string) string {
+	if color == "" {
+		return s
+	}
+	return color + s + ansiReset
+}
+
+func (opts *CheckOpts) colorize(level string, s string) string {
+	if opts.output() != OutputColor {
+		return s
+	}
+	return colorize(severityColors[level], s)
+}
+
+func formatApplied(ur *UserReport, color bool) string {
+	ls := []string{fmt.Sprintf("%s applied changes:\n", ur.User)}
+	for _, rec := range ur.Applied {
+		line := fmt.Sprintf("\t* %s", formatRecord(rec))
+		if rec.Outcome != AuditOutcomeOk {
+			line += ": " + rec.Error
+			if color {
+				line = colorize(ansiRed, line)
+			}
+		} else if color {
+			line = colorize(ansiGreen, line)
+		}
+		ls = append(ls, line)
+	}
+	return strings.Join(ls, "\n") + "\n"
+}
+
+func formatRecord(rec *AuditRecord) string {
+	ls := []string{rec.Op}
+	for _, s := range []string{rec.Prefix, rec.Key} {
+		if s != "" {
+			ls = append(ls, s)
+		}
+	}
+	if rec.Prefix != "" && rec.New != nil {
+		ls = append(ls, jsonValue(rec.New))
+	}
+	return strings.Join(ls, " ")
+}
+
+func formatReportText(report *Report, color bool) string {
+	ls := []string{}
+	for _, cr := range report.Checks {
+		for _, ur := range cr.Users {
+			for _, level := range severityLevels {
+				fs := []string{}
+				for _, f := range ur.Findings {
+					if f.Severity == level {
+						fs = append(fs, "\t* "+formatFinding(f))
+					}
+				}
+				if len(fs) != 0 {
+					block := fmt.Sprintf("%s check %s:\n\n%s\n", ur.User, severityTitles[level], strings.Join(fs, "\n"))
+					if color {
+						block = colorize(severityColors[level], block)
+					}
+					ls = append(ls, block)
+				}
+			}
+			if len(ur.Applied) != 0 {
+				ls = append(ls, formatApplied(ur, color))
+			}
+		}
+	}
+	return strings.Join(ls, "\n")
+}
+
+func formatFinding(f *Finding) string {
+	ls := []string{f.Category, f.Kind}
+	for _, s := range []string{f.Prefix, f.Key} {
+		if s != "" {
+			ls = append(ls, s)
+		}
+	}
+	desc := strings.Join(ls, " ")
+	switch {
+	case f.Kind == KindTemplates && f.Key != "", f.Kind == KindUsers:
+		return desc
+	case f.Kind == KindRules:
+		return fmt.Sprintf("%s %s", f.Category, formatRuleFinding(f))
+	case f.Category == CategoryWrong:
+		return fmt.Sprintf("%s: wants %s has %s", desc, jsonValue(f.Wants), jsonValue(f.Has))
+	case f.Category == CategoryMissing:
+		return fmt.Sprintf("%s: wants %s", desc, jsonValue(f.Wants))
+	default:
+		return fmt.Sprintf("%s: has %s", desc, jsonValue(f.Has))
+	}
+}
+
+func checkTitle(cr *CheckReport) string {
+	title := cr.Prefix
+	if cr.Name != "" {
+		title = cr.Name + " (" + cr.Prefix + ")"
+	}
+	if cr.OnlySubUsers {
+		title += " sub users"
+	}
+	if cr.Environment != "" {
+		title = cr.Environment + ": " + title
+	}
+	return title
+}
+
+func markdownCell(s string) string {
+	return strings.NewReplacer("|", "\\|", "\n", " ").Replace(s)
+}
+
+func markdownValue(value interface{}) string {
+	if value == nil {
+		return ""
+	}
+	return "`" + markdownCell(jsonValue(value)) + "`"
+}
+
+func formatReportMarkdown(report *Report) string {
+	ls := []string{}
+	status := "passed"
+	if report.Error != "" {
+		status = "failed"
+	}
+	mode := "Check"
+	if report.Apply {
+		mode = "Apply"
+	}
+	ls = append(ls, fmt.Sprintf("# %s %s\n", mode, status))
+	if len(report.Conflicts) != 0 {
+		ls = append(ls, "## Conflicts\n")
+		for _, c := range report.Conflicts {
+			ls = append(ls, "- "+markdownCell(c.String()))
+		}
+		ls = append(ls, "")
+	}
+	for _, cr := range report.Checks {
+		ls = append(ls, fmt.Sprintf("## %s\n", markdownCell(checkTitle(cr))))
+		if cr.Error != "" {
+			ls = append(ls, fmt.Sprintf("**Error:** %s\n", markdownCell(cr.Error)))
+		}
+		for _, ur := range cr.Users {
+			if len(ur.Findings) == 0 && len(ur.Applied) == 0 {
+				continue
+			}
+			ls = append(ls, fmt.Sprintf("### %s\n", markdownCell(ur.User)))
+			if len(ur.Findings) != 0 {
+				ls = append(ls, "| Severity | Kind | Category | Prefix | Key | Has | Wants |", "|---|---|---|---|---|---|---|")
+				for _, f := range ur.Findings {
+					ls = append(ls, fmt.Sprintf("| %s | %s | %s | %s | %s | %s | %s |", f.Severity, f.Kind, f.Category, markdownCell(f.Prefix), markdownCell(findingKey(f)), markdownValue(f.Has), markdownValue(f.Wants)))
+				}
+				ls = append(ls, "")
+			}
+			if len(ur.Applied) != 0 {
+				ls = append(ls, "| Applied | Prefix | Key | Old | New | Outcome |", "|---|---|---|---|---|---|")
+				for _, rec := range ur.Applied {
+					outcome := rec.Outcome
+					if rec.Error != "" {
+						outcome += ": " + rec.Error
+					}
+					ls = append(ls, fmt.Sprintf("| %s | %s | %s | %s | %s | %s |", rec.Op, markdownCell(rec.Prefix), markdownCell(rec.Key), markdownValue(rec.Old), markdownValue(rec.New), markdownCell(outcome)))
+				}
+				ls = append(ls, "")
+			}
+		}
+	}
+	if report.Error != "" {
+		ls = append(ls, "## Errors\n", "```", report.Error, "```", "")
+	}
+	return strings.Join(ls, "\n")
+}
+
+var reportHTMLTemplate = template.Must(template.New("report").Funcs(template.FuncMap{
+	"json":  jsonValue,
+	"set":   func(value interface{}) bool { return value != nil },
+	"key":   findingKey,
+	"title": checkTitle,
+	"failed": func(cr *CheckReport) bool {
+		return cr.Error != "" || cr.hasSeverity(SeverityError)
+	},
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>nxusercheck report</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; margin: 0.5em 0 1em; }
+th, td { border: 1px solid #ccc; padding: 0.2em 0.6em; text-align: left; }
+td code { white-space: pre-wrap; }
+summary { font-size: 1.2em; font-weight: bold; cursor: pointer; }
+.error { color: #b00020; }
+.warn { color: #a06000; }
+.info { color: #555; }
+.ok { color: #1b7a1b; }
+</style>
+</head>
+<body>
+<h1>{{if .Apply}}Apply{{else}}Check{{end}} {{if .Error}}<span class="error">failed</span>{{else}}<span class="ok">passed</span>{{end}}</h1>
+<p>{{.Start.Format "2006-01-02 15:04:05 MST"}}</p>
+{{if .Conflicts}}<h2>Conflicts</h2>
+<ul>{{range .Conflicts}}<li>{{.String}}</li>{{end}}</ul>
+{{end}}{{range .Checks}}<details{{if failed .}} open{{end}}>
+<summary>{{title .}}</summary>
+{{if .Error}}<p class="error">{{.Error}}</p>
+{{end}}{{range .Users}}{{if or .Findings .Applied}}<h3>{{.User}}</h3>
+{{if .Findings}}<table>
+<tr><th>Severity</th><th>Kind</th><th>Category</th><th>Prefix</th><th>Key</th><th>Has</th><th>Wants</th></tr>
+{{range .Findings}}<tr class="{{.Severity}}"><td>{{.Severity}}</td><td>{{.Kind}}</td><td>{{.Category}}</td><td>{{.Prefix}}</td><td>{{key .}}</td><td>{{if set .Has}}<code>{{json .Has}}</code>{{end}}</td><td>{{if set .Wants}}<code>{{json .Wants}}</code>{{end}}</td></tr>
+{{end}}</table>
+{{end}}{{if .Applied}}<table>
+<tr><th>Applied</th><th>Prefix</th><th>Key</th><th>Old</th><th>New</th><th>Outcome</th></tr>
+{{range .Applied}}<tr class="{{if eq .Outcome "ok"}}ok{{else}}error{{end}}"><td>{{.Op}}</td><td>{{.Prefix}}</td><td>{{.Key}}</td><td>{{if set .Old}}<code>{{json .Old}}</code>{{end}}</td><td>{{if set .New}}<code>{{json .New}}</code>{{end}}</td><td>{{.Outcome}}{{if .Error}}: {{.Error}}{{end}}</td></tr>
+{{end}}</table>
+{{end}}{{end}}{{end}}</details>
+{{end}}{{if .Error}}<h2>Errors</h2>
+<pre class="error">{{.Error}}</pre>
+{{end}}</body>
+</html>
+`))
+
+func formatReportHTML(report *Report) (string, error) {
+	buf := &bytes.Buffer{}
+	if err := reportHTMLTemplate.Execute(buf, report); err != nil {
+		return "", fmt.Errorf("Error rendering report: %s", err.Error())
+	}
+	return buf.String(), nil
+}
@@ -0,0 +1,212 @@
+package nxusercheck
+
+import (
+	"time"
+)
+
+const (
+	KindTemplates   = "templates"
+	KindTags        = "tags"
+	KindPermissions = "permissions"
+
+	CategoryWrong   = "wrong"
+	CategoryMissing = "missing"
+	CategoryExtra   = "extra"
+
+	SeverityIgnore  = "ignore"
+	SeverityInfo    = "info"
+	SeverityWarning = "warn"
+	SeverityError   = "error"
+)
+
+// Report holds the structured results of a check or apply run.
+type Report struct {
+	Apply     bool           `json:"apply"`
+	Start     time.Time      `json:"start"`
+	Duration  time.Duration  `json:"duration"`
+	Checks    []*CheckReport `json:"checks"`
+	Conflicts []*Conflict    `json:"conflicts,omitempty"`
+
+	ExpiredExemptions []*Exemption `json:"expiredExemptions,omitempty"`
+	UnusedExemptions  []*Exemption `json:"unusedExemptions,omitempty"`
+
+	Error string `json:"error,omitempty"`
+}
+
+type CheckReport struct {
+	Environment  string         `json:"environment,omitempty"`
+	Name         string         `json:"name,omitempty"`
+	Prefix       string         `json:"prefix"`
+	OnlySubUsers bool           `json:"onlySubUsers"`
+	Created      bool           `json:"created,omitempty"`
+	Opts         *EffectiveOpts `json:"opts,omitempty"`
+	Users        []*UserReport  `json:"users"`
+	Retries      int            `json:"retries,omitempty"`
+	Error        string         `json:"error,omitempty"`
+}
+
+type UserReport struct {
+	User     string         `json:"user"`
+	Findings []*Finding     `json:"findings"`
+	Exempted []*Finding     `json:"exempted,omitempty"`
+	Plan     []*PlanOp      `json:"plan,omitempty"`
+	Skipped  []*PlanOp      `json:"skipped,omitempty"`
+	Applied  []*AuditRecord `json:"applied,omitempty"`
+	Retries  int            `json:"retries,omitempty"`
+	Error    string         `json:"error,omitempty"`
+
+	unresolved int
+}
+
+// Finding is a single difference between what a user has and what a check
+// wants. Templates findings compare the whole list of templates. Rules
+// findings come from the custom rules of the check.
+type Finding struct {
+	Kind      string      `json:"kind"`
+	Rule      string      `json:"rule,omitempty"`
+	Category  string      `json:"category"`
+	Severity  string      `json:"severity"`
+	Prefix    string      `json:"prefix,omitempty"`
+	Key       string      `json:"key,omitempty"`
+	Has       interface{} `json:"has,omitempty"`
+	Wants     interface{} `json:"wants,omitempty"`
+	Message   string      `json:"message,omitempty"`
+	Exemption *Exemption  `json:"exemption,omitempty"`
+}
+
+// PlanOp is a change that is applied, or would be applied on a dry run, to
+// fix the error level findings of a user.
+type PlanOp struct {
+	Op     string      `json:"op"`
+	Prefix string      `json:"prefix,omitempty"`
+	Key    string      `json:"key"`
+	Value  interface{} `json:"value,omitempty"`
+	Reason string      `json:"reason,omitempty"`
+}
+
+func newReport(apply bool) *Report {
+	return &Report{Apply: apply, Start: time.Now(), Checks: []*CheckReport{}}
+}
+
+func (r *Report) addCheck(uc *UsersCheck) *CheckReport {
+	cr := &CheckReport{Name: uc.Name, Prefix: uc.Prefix, OnlySubUsers: uc.OnlySubUsers, Users: []*UserReport{}}
+	r.Checks = append(r.Checks, cr)
+	return cr
+}
+
+func (cr *CheckReport) user(user string) *UserReport {
+	for _, ur := range cr.Users {
+		if ur.User == user {
+			return ur
+		}
+	}
+	ur := &UserReport{User: user, Findings: []*Finding{}}
+	cr.Users = append(cr.Users, ur)
+	return ur
+}
+
+func (cr *CheckReport) setCreated() {
+	if cr != nil {
+		cr.Created = true
+	}
+}
+
+func (cr *CheckReport) setError(err error) {
+	if cr != nil && err != nil {
+		cr.Error = err.Error()
+	}
+}
+
+func (cr *CheckReport) hasSeverity(severity string) bool {
+	for _, ur := range cr.Users {
+		for _, f := range ur.Findings {
+			if f.Severity == severity {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// unresolved returns the users that still don't pass the check after
+// applying it because some of their changes were skipped or some error level
+// findings have no changes to fix them.
+func (cr *CheckReport) unresolved() []string {
+	users := []string{}
+	for _, ur := range cr.Users {
+		if len(ur.Skipped) != 0 || ur.unresolved != 0 {
+			users = append(users, ur.User)
+		}
+	}
+	return users
+}
+
+func (opts *CheckOpts) userReport(user string) *UserReport {
+	if opts.checkReport == nil {
+		return &UserReport{User: user, Findings: []*Finding{}}
+	}
+	return opts.checkReport.user(user)
+}
+
+func (opts *CheckOpts) observeReport() {
+	if opts.report == nil {
+		return
+	}
+	opts.report.Duration = time.Since(opts.report.Start)
+	metrics := opts.Metrics
+	if metrics == nil && opts.MetricsFile != "" {
+		metrics = fileMetrics(opts.MetricsFile)
+	}
+	if metrics == nil {
+		return
+	}
+	metrics.Observe(opts.report)
+	if opts.MetricsFile != "" {
+		if err := metrics.WriteTextfile(opts.MetricsFile); err != nil && opts.report.Error == "" {
+			opts.report.Error = err.Error()
+		}
+	}
+}
+
+func (ur *UserReport) addTemplatesFinding(category string, severity string, has []string, wants []string) {
+	if severity == SeverityIgnore {
+		return
+	}
+	ur.Findings = append(ur.Findings, &Finding{
+		Kind:     KindTemplates,
+		Category: category,
+		Severity: severity,
+		Has:      append([]string{}, has...),
+		Wants:    append([]string{}, wants...),
+	})
+}
+
+func (ur *UserReport) addTemplateFinding(category string, severity string, tpl string) {
+	if severity == SeverityIgnore {
+		return
+	}
+	ur.Findings = append(ur.Findings, &Finding{Kind: KindTemplates, Category: category, Severity: severity, Key: tpl})
+}
+
+func (ur *UserReport) addFindings(kind string, severity string, wrong, missing, extra map[string]map[string]interface{}) {
+	if severity == SeverityIgnore {
+		return
+	}
+	for _, prefix := range sortedKeys(wrong) {
+		for _, key := range sortedKeys(wrong[prefix]) {
+			ur.Findings = append(ur.Findings, &Finding{Kind: kind, Category: CategoryWrong, Severity: severity, Prefix: prefix, Key: key, Has: wrong[prefix][key], Wants: missing[prefix][key]})
+		}
+	}
+	for _, prefix := range sortedKeys(missing) {
+		for _, key := range sortedKeys(missing[prefix]) {
+			if _, ok := wrong[prefix][key]; !ok {
+				ur.Findings = append(ur.Findings, &Finding{Kind: kind, Category: CategoryMissing, Severity: severity, Prefix: prefix, Key: key, Wants: missing[prefix][key]})
+			}
+		}
+	}
+	for _, prefix := range sortedKeys(extra) {
+		for _, key := range sortedKeys(extra[prefix]) {
+			ur.Findings = append(ur.Findings, &Finding{Kind: kind, Category: CategoryExtra, Severity: severity, Prefix: prefix, Key: key, Has: extra[prefix][key]})
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package nxusercheck
+
+import (
+	"errors"
+	"math/rand"
+	"time"
+
+	nx "github.com/nayarsystems/nxgo/nxcore"
+)
+
+// RetryOpts configures the retries of failed nexus calls. Calls are tried up
+// to MaxAttempts times waiting an exponential backoff with jitter between
+// attempts. Only errors with one of the Codes (timeouts and internal errors by
+// default) or not coming from nexus are retried.
+type RetryOpts struct {
+	MaxAttempts  int   `json:"maxAttempts"`
+	BackoffMs    int   `json:"backoffMs"`
+	MaxBackoffMs int   `json:"maxBackoffMs"`
+	Codes        []int `json:"codes"`
+}
+
+var defaultRetryCodes = []int{nx.ErrTimeout, nx.ErrInternal, nx.ErrTtlExpired}
+
+func (ro *RetryOpts) retryable(err error) bool {
+	var jerr *nx.JsonRpcErr
+	if !errors.As(err, &jerr) {
+		return true
+	}
+	codes := ro.Codes
+	if codes == nil {
+		codes = defaultRetryCodes
+	}
+	for _, code := range codes {
+		if jerr.Cod == code {
+			return true
+		}
+	}
+	return false
+}
+
+func (ro *RetryOpts) backoff(attempt int) time.Duration {
+	backoff := time.Duration(ro.BackoffMs) * time.Millisecond
+	if backoff <= 0 {
+		backoff = 100 * time.Millisecond
+	}
+	max := time.Duration(ro.MaxBackoffMs) * time.Millisecond
+	for i := 1; i < attempt && (max <= 0 || backoff < max); i++ {
+		backoff *= 2
+	}
+	if max > 0 && backoff > max {
+		backoff = max
+	}
+	return backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+}
+
+// retry runs a nexus call retrying it on transient errors. Retries are counted
+// in the report of the user, or of the check when user is empty.
+func (opts *CheckOpts) retry(user string, f func() error) error {
+	ro := opts.Retry
+	if ro == nil {
+		ro = opts.fileOpts().Retry
+	}
+	err := f()
+	if ro == nil {
+		return err
+	}
+	for attempt := 1; err != nil && attempt < ro.MaxAttempts && ro.retryable(err); attempt++ {
+		time.Sleep(ro.backoff(attempt))
+		if user != "" {
+			opts.userReport(user).Retries++
+		} else if opts.checkReport != nil {
+			opts.checkReport.Retries++
+		}
+		err = f()
+	}
+	return err
+}
@@ -0,0 +1,72 @@
+package nxusercheck
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Role is a named bundle of templates, permissions and tags that checks can
+// reference with "roles": ["name"] or "name:some.prefix". The {prefix}
+// placeholder inside the role is replaced by the given prefix (or the check
+// prefix when none is given).
+type Role struct {
+	Templates   []string     `json:"templates"`
+	Permissions *Permissions `json:"permissions"`
+	Tags        *Tags        `json:"tags"`
+}
+
+const roleParam = "{prefix}"
+
+func (uc *UsersCheck) expandRoles(roles map[string]*Role) error {
+	for _, ref := range uc.Roles {
+		name, param := ref, uc.Prefix
+		if i := strings.Index(ref, ":"); i >= 0 {
+			name, param = ref[:i], ref[i+1:]
+		}
+		role, ok := roles[name]
+		if !ok || role == nil {
+			return fmt.Errorf("unknown role %s", name)
+		}
+		source := fmt.Sprintf("role %s", ref)
+		if role.Templates != nil {
+			if uc.fullTemplates == nil {
+				uc.fullTemplates = []string{}
+			}
+			for _, tpl := range role.Templates {
+				tpl = expandParam(tpl, param)
+				if !containsString(uc.fullTemplates, tpl) {
+					uc.fullTemplates = append(uc.fullTemplates, tpl)
+				}
+			}
+		}
+		if role.Permissions != nil {
+			if uc.fullPermissions == nil {
+				uc.fullPermissions = T{}
+			}
+			uc.addPermissions(uc.fullPermissions, role.Permissions, source+" permissions", param)
+		}
+		if role.Tags != nil {
+			if uc.fullTags == nil {
+				uc.fullTags = T{}
+			}
+			uc.addTags(uc.fullTags, role.Tags, source+" tags", param)
+		}
+	}
+	return nil
+}
+
+func expandParam(s string, param string) string {
+	if param == "" {
+		return s
+	}
+	return strings.Replace(s, roleParam, param, -1)
+}
+
+func containsString(l []string, s string) bool {
+	for _, e := range l {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,253 @@
+package nxusercheck
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+
+	nx "github.com/nayarsystems/nxgo/nxcore"
+)
+
+const KindRules = "rules"
+
+// Rule is a custom requirement checked on every user of a check alongside
+// its templates, tags and permissions. Rules are set on UsersCheck.Rules or,
+// for all the checks, on CheckOpts.Rules.
+type Rule interface {
+	Name() string
+	Check(rc *RuleContext, user *nx.UserInfo) ([]*RuleFinding, error)
+}
+
+type RuleContext struct {
+	Check *UsersCheck
+	Conn  *nx.NexusConn
+	Apply bool
+}
+
+// RuleFinding is a requirement a user does not meet. Category defaults to
+// wrong and Severity to error, and both can be overridden with the "rules"
+// severity of the check. The Ops (addTemplate, delTemplate, setTag or delTag)
+// are applied to fix error level findings.
+type RuleFinding struct {
+	Category string
+	Severity string
+	Prefix   string
+	Key      string
+	Has      interface{}
+	Wants    interface{}
+	Message  string
+	Ops      []*PlanOp
+}
+
+func (uc *UsersCheck) rules(opts *CheckOpts) []Rule {
+	return append(append(append([]Rule{}, opts.Rules...), uc.Rules...), uc.exprRules...)
+}
+
+// checkRules runs the rules of the check on a user and returns the templates
+// operations to plan, adding the tags ones to wrong, set and del. Error level
+// findings without operations to fix them are counted as unresolved.
+func (uc *UsersCheck) checkRules(userInfo *nx.UserInfo, opts *CheckOpts, ur *UserReport, outs map[string][]string, wrong, set, del T) []*PlanOp {
+	rc := &RuleContext{Check: uc, Conn: uc.nexusConn, Apply: opts.apply}
+	found := map[string][]string{}
+	templatesPlan := []*PlanOp{}
+	for _, rule := range uc.rules(opts) {
+		rfs, err := rule.Check(rc, userInfo)
+		if err != nil {
+			rfs = []*RuleFinding{{Message: fmt.Sprintf("Error running rule: %s", err.Error())}}
+		}
+		for _, rf := range rfs {
+			if rf == nil {
+				continue
+			}
+			f := &Finding{Kind: KindRules, Rule: rule.Name(), Category: rf.Category, Prefix: rf.Prefix, Key: rf.Key, Has: rf.Has, Wants: rf.Wants, Message: rf.Message}
+			if f.Category == "" {
+				f.Category = CategoryWrong
+			}
+			if e := opts.exemption(userInfo.User, KindRules, f.Prefix, f.Rule); e != nil {
+				ur.addExempted(f, e)
+				continue
+			}
+			f.Severity = uc.ruleSeverity(opts, f.Category, rf.Severity)
+			if f.Severity == SeverityIgnore {
+				continue
+			}
+			ur.Findings = append(ur.Findings, f)
+			found[f.Severity] = append(found[f.Severity], fmt.Sprintf("\t* %s", formatRuleFinding(f)))
+			if f.Severity != SeverityError {
+				continue
+			}
+			if len(rf.Ops) == 0 {
+				ur.unresolved++
+			}
+			for _, op := range rf.Ops {
+				if err := addRuleOp(userInfo, op, wrong, set, del); err != nil {
+					found[SeverityError] = append(found[SeverityError], fmt.Sprintf("\t* %s: %s", f.Rule, err.Error()))
+					ur.unresolved++
+					continue
+				}
+				if op.Op == AuditAddTemplate || op.Op == AuditDelTemplate {
+					templatesPlan = append(templatesPlan, op)
+				}
+			}
+		}
+	}
+	for _, level := range severityLevels {
+		if len(found[level]) != 0 {
+			outs[level] = append(outs[level], fmt.Sprintf("\tRULES:\n\n%s\n", strings.Join(found[level], "\n")))
+		}
+	}
+	return templatesPlan
+}
+
+func (uc *UsersCheck) ruleSeverity(opts *CheckOpts, category string, severity string) string {
+	for _, sv := range []Severities{opts.Severity, uc.Severity, opts.fileOpts().Severity} {
+		if level := sv[KindRules][category]; level != "" {
+			return level
+		}
+	}
+	if severity == "" {
+		return SeverityError
+	}
+	return severity
+}
+
+// addRuleOp adds a tags operation of a rule to the plan, replacing any other
+// operation on the same key.
+func addRuleOp(userInfo *nx.UserInfo, op *PlanOp, wrong, set, del T) error {
+	switch op.Op {
+	case AuditAddTemplate, AuditDelTemplate:
+		if op.Key == "" {
+			return fmt.Errorf("invalid operation %s: missing template", op.Op)
+		}
+	case AuditSetTag, AuditDelTag:
+		if op.Prefix == "" || op.Key == "" {
+			return fmt.Errorf("invalid operation %s: missing prefix or key", op.Op)
+		}
+		delete(set[op.Prefix], op.Key)
+		delete(del[op.Prefix], op.Key)
+		delete(wrong[op.Prefix], op.Key)
+		has, ok := userInfo.Tags[op.Prefix][op.Key]
+		if op.Op == AuditDelTag {
+			if ok {
+				addPrefTagVal(del, op.Prefix, op.Key, has)
+			}
+			break
+		}
+		if ok {
+			if reflect.DeepEqual(normalizeValue(has), normalizeValue(op.Value)) {
+				break
+			}
+			addPrefTagVal(wrong, op.Prefix, op.Key, has)
+		}
+		addPrefTagVal(set, op.Prefix, op.Key, op.Value)
+	default:
+		return fmt.Errorf("invalid operation %s", op.Op)
+	}
+	return nil
+}
+
+func formatRuleFinding(f *Finding) string {
+	ls := []string{f.Rule}
+	for _, s := range []string{f.Prefix, f.Key} {
+		if s != "" {
+			ls = append(ls, s)
+		}
+	}
+	desc := strings.Join(ls, " ")
+	if f.Message != "" {
+		desc += ": " + f.Message
+	}
+	if f.Has != nil || f.Wants != nil {
+		desc += fmt.Sprintf(" (wants %s has %s)", jsonValue(f.Wants), jsonValue(f.Has))
+	}
+	return desc
+}
+
+// findingKey is the key of a finding in tables, which for rules also names the
+// rule and has its message.
+func findingKey(f *Finding) string {
+	if f.Kind != KindRules {
+		return f.Key
+	}
+	return formatRuleFinding(&Finding{Rule: f.Rule, Key: f.Key, Message: f.Message})
+}
+
+// ExprRule is a rule defined in the config by an expression (see expr.go)
+// that users must meet, evaluated with the variables user, prefix (of the
+// check), templates and tags (including permissions). When set, the rule only
+// applies to users meeting the When expression.
+type ExprRule struct {
+	Name     string `json:"name"`
+	When     string `json:"when,omitempty"`
+	Expr     string `json:"expr"`
+	Message  string `json:"message"`
+	Category string `json:"category,omitempty"`
+	Severity string `json:"severity,omitempty"`
+}
+
+type exprRule struct {
+	def  *ExprRule
+	when exprNode
+	expr exprNode
+}
+
+func (er *ExprRule) compile() (*exprRule, error) {
+	if er.Name == "" {
+		return nil, fmt.Errorf("invalid rule: missing name")
+	}
+	if er.Category != "" && er.Category != CategoryWrong && er.Category != CategoryMissing && er.Category != CategoryExtra {
+		return nil, fmt.Errorf("invalid rule %s: invalid category %s", er.Name, er.Category)
+	}
+	if er.Severity != "" && er.Severity != SeverityIgnore && !containsString(severityLevels, er.Severity) {
+		return nil, fmt.Errorf("invalid rule %s: invalid severity %s", er.Name, er.Severity)
+	}
+	r := &exprRule{def: er}
+	var err error
+	if er.When != "" {
+		if r.when, err = parseExpr(er.When); err != nil {
+			return nil, fmt.Errorf("invalid rule %s: when: %s", er.Name, err.Error())
+		}
+	}
+	if r.expr, err = parseExpr(er.Expr); err != nil {
+		return nil, fmt.Errorf("invalid rule %s: expr: %s", er.Name, err.Error())
+	}
+	return r, nil
+}
+
+func (r *exprRule) Name() string {
+	return r.def.Name
+}
+
+func (r *exprRule) Check(rc *RuleContext, user *nx.UserInfo) ([]*RuleFinding, error) {
+	env := exprEnv(rc.Check.Prefix, user)
+	if r.when != nil {
+		v, err := r.when.eval(env)
+		if err != nil {
+			return nil, fmt.Errorf("when: %s", err.Error())
+		}
+		if !exprTruthy(v) {
+			return nil, nil
+		}
+	}
+	v, err := r.expr.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	if exprTruthy(v) {
+		return nil, nil
+	}
+	message := r.def.Message
+	if message == "" {
+		message = fmt.Sprintf("%s is not met", r.def.Expr)
+	}
+	return []*RuleFinding{{Category: r.def.Category, Severity: r.def.Severity, Message: message}}, nil
+}
+
+func exprEnv(prefix string, user *nx.UserInfo) map[string]interface{} {
+	return map[string]interface{}{
+		"user":      user.User,
+		"prefix":    prefix,
+		"templates": normalizeValue(append([]string{}, user.Templates...)),
+		"tags":      normalizeValue(user.Tags),
+	}
+}
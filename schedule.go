@@ -0,0 +1,144 @@
+package nxusercheck
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cronSchedule is a standard 5 field cron expression (minute, hour, day of
+// month, month and day of week) supporting *, lists, ranges and steps.
+type cronSchedule struct {
+	minute, hour, dom, month, dow map[int]bool
+	domAny, dowAny                bool
+}
+
+var cronShortcuts = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+func parseCron(expr string) (*cronSchedule, error) {
+	if shortcut, ok := cronShortcuts[strings.TrimSpace(expr)]; ok {
+		expr = shortcut
+	}
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("Error parsing cron expression %q: expected 5 fields", expr)
+	}
+	cs := &cronSchedule{domAny: fields[2] == "*", dowAny: fields[4] == "*"}
+	var err error
+	bounds := [][2]int{{0, 59}, {0, 23}, {1, 31}, {1, 12}, {0, 7}}
+	sets := []*map[int]bool{&cs.minute, &cs.hour, &cs.dom, &cs.month, &cs.dow}
+	for i, field := range fields {
+		if *sets[i], err = parseCronField(field, bounds[i][0], bounds[i][1]); err != nil {
+			return nil, fmt.Errorf("Error parsing cron expression %q: %s", expr, err.Error())
+		}
+	}
+	if cs.dow[7] {
+		cs.dow[0] = true
+	}
+	if !cs.possible() {
+		return nil, fmt.Errorf("Error parsing cron expression %q: never matches", expr)
+	}
+	return cs, nil
+}
+
+// cronMonthDays are the most days of each month, counting leap years.
+var cronMonthDays = []int{0, 31, 29, 31, 30, 31, 30, 31, 31, 30, 31, 30, 31}
+
+// possible tells if some selected month has some selected day of month. With
+// days of week set too, any day of week matches.
+func (cs *cronSchedule) possible() bool {
+	if cs.domAny || !cs.dowAny {
+		return true
+	}
+	for month := range cs.month {
+		for day := range cs.dom {
+			if day <= cronMonthDays[month] {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func parseCronField(field string, min int, max int) (map[int]bool, error) {
+	set := map[int]bool{}
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			var err error
+			if step, err = strconv.Atoi(part[i+1:]); err != nil || step <= 0 {
+				return nil, fmt.Errorf("invalid step in %q", part)
+			}
+			part = part[:i]
+		}
+		from, to := min, max
+		if part != "*" {
+			bounds := strings.SplitN(part, "-", 2)
+			var err error
+			if from, err = strconv.Atoi(bounds[0]); err != nil {
+				return nil, fmt.Errorf("invalid value %q", part)
+			}
+			to = from
+			if len(bounds) == 2 {
+				if to, err = strconv.Atoi(bounds[1]); err != nil {
+					return nil, fmt.Errorf("invalid value %q", part)
+				}
+			} else if step != 1 {
+				to = max
+			}
+		}
+		if from < min || to > max || from > to {
+			return nil, fmt.Errorf("value %q out of range [%d-%d]", part, min, max)
+		}
+		for v := from; v <= to; v += step {
+			set[v] = true
+		}
+	}
+	return set, nil
+}
+
+func (cs *cronSchedule) dayMatches(t time.Time) bool {
+	domMatch := cs.dom[t.Day()]
+	dowMatch := cs.dow[int(t.Weekday())]
+	switch {
+	case cs.domAny && cs.dowAny:
+		return true
+	case cs.domAny:
+		return dowMatch
+	case cs.dowAny:
+		return domMatch
+	default:
+		return domMatch || dowMatch
+	}
+}
+
+// Next returns the first time matching the schedule strictly after t, or the
+// zero time if there is none in the next five years.
+func (cs *cronSchedule) Next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		switch {
+		case !cs.month[int(t.Month())]:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+		case !cs.dayMatches(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+		case !cs.hour[t.Hour()]:
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+		case !cs.minute[t.Minute()]:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
@@ -0,0 +1,84 @@
+package nxusercheck
+
+import (
+	"fmt"
+)
+
+// Severities sets the severity level (ignore, info, warn or error) of each
+// finding category (wrong, missing, extra) by kind (templates, tags,
+// permissions), e.g. {"tags": {"extra": "error"}}.
+type Severities map[string]map[string]string
+
+var severityLevels = []string{SeverityError, SeverityWarning, SeverityInfo}
+
+var severityTitles = map[string]string{
+	SeverityError:   "errors",
+	SeverityWarning: "warnings",
+	SeverityInfo:    "info",
+}
+
+func (sv Severities) validate() error {
+	for kind, categories := range sv {
+		if kind != KindTemplates && kind != KindTags && kind != KindPermissions && kind != KindRules {
+			return fmt.Errorf("invalid severity kind %s", kind)
+		}
+		for category, level := range categories {
+			if category != CategoryWrong && category != CategoryMissing && category != CategoryExtra {
+				return fmt.Errorf("invalid severity category %s.%s", kind, category)
+			}
+			if level != SeverityIgnore && level != SeverityInfo && level != SeverityWarning && level != SeverityError {
+				return fmt.Errorf("invalid severity level %s for %s.%s", level, kind, category)
+			}
+		}
+	}
+	return nil
+}
+
+func (uc *UsersCheck) severity(opts *CheckOpts, kind string, category string) string {
+	for _, sv := range []Severities{opts.Severity, uc.Severity, opts.fileOpts().Severity} {
+		if level := sv[kind][category]; level != "" {
+			return level
+		}
+	}
+	if category != CategoryExtra {
+		return SeverityError
+	}
+	switch kind {
+	case KindTemplates:
+		if uc.allowExtraTemplates(opts) {
+			return SeverityIgnore
+		}
+		return SeverityError
+	case KindTags:
+		if uc.noExtraTags(opts) {
+			return SeverityError
+		}
+	case KindPermissions:
+		if uc.noExtraPermissions(opts) {
+			return SeverityError
+		}
+	}
+	return SeverityWarning
+}
+
+func diffTemplates(has []string, wants []string, allowExtra bool) (bool, []string, []string) {
+	missing := []string{}
+	extra := []string{}
+	present := []string{}
+	for _, tpl := range wants {
+		if containsString(has, tpl) {
+			present = append(present, tpl)
+		} else {
+			missing = append(missing, tpl)
+		}
+	}
+	ordered := []string{}
+	for _, tpl := range has {
+		if containsString(wants, tpl) {
+			ordered = append(ordered, tpl)
+		} else if !allowExtra {
+			extra = append(extra, tpl)
+		}
+	}
+	return !checkTemplatesExactMatch(ordered, present), missing, extra
+}
@@ -0,0 +1,132 @@
+package nxusercheck
+
+import (
+	"fmt"
+	"strings"
+
+	nx "github.com/nayarsystems/nxgo/nxcore"
+)
+
+// templatesPlan returns the operations that fix the error level template
+// findings of a user, when fix is set, and apply the templates operations of
+// the rules. Exempted or allowed templates are left untouched.
+func (uc *UsersCheck) templatesPlan(userInfo *nx.UserInfo, allowExtra bool, fix bool, rulesOps []*PlanOp, ur *UserReport, opts *CheckOpts) []*PlanOp {
+	keepAll := !fix || allowExtra || uc.severity(opts, KindTemplates, CategoryExtra) != SeverityError
+	keepOrder := !fix || uc.severity(opts, KindTemplates, CategoryWrong) != SeverityError
+	exemptedMissing := map[string]bool{}
+	exemptedExtra := map[string]bool{}
+	for _, f := range ur.Exempted {
+		switch {
+		case f.Kind != KindTemplates:
+		case f.Category == CategoryMissing:
+			exemptedMissing[f.Key] = true
+		case f.Category == CategoryExtra:
+			exemptedExtra[f.Key] = true
+		case f.Category == CategoryWrong:
+			keepOrder = true
+		}
+	}
+	wants := []string{}
+	if keepOrder {
+		for _, tpl := range userInfo.Templates {
+			if (!fix || containsString(uc.fullTemplates, tpl)) && !containsString(wants, tpl) {
+				wants = append(wants, tpl)
+			}
+		}
+	}
+	if fix {
+		for _, tpl := range uc.fullTemplates {
+			if !exemptedMissing[tpl] && !containsString(wants, tpl) {
+				wants = append(wants, tpl)
+			}
+		}
+	}
+	deleted := map[string]bool{}
+	for _, op := range rulesOps {
+		switch op.Op {
+		case AuditAddTemplate:
+			delete(deleted, op.Key)
+			if !containsString(wants, op.Key) {
+				wants = append(wants, op.Key)
+			}
+		case AuditDelTemplate:
+			deleted[op.Key] = true
+			kept := []string{}
+			for _, tpl := range wants {
+				if tpl != op.Key {
+					kept = append(kept, tpl)
+				}
+			}
+			wants = kept
+		}
+	}
+	keep := func(tpl string) bool {
+		return !deleted[tpl] && (keepAll || exemptedExtra[tpl])
+	}
+	return planTemplates(userInfo.Templates, wants, keep)
+}
+
+// planTemplates returns the minimal sequence of deletions and additions that
+// turns has into wants. Templates can only be appended, so it keeps the longest
+// prefix of wants found in order in has, deletes everything else but the
+// unwanted templates keep allows and appends the rest of wants.
+func planTemplates(has []string, wants []string, keep func(tpl string) bool) []*PlanOp {
+	limit := len(wants)
+	for {
+		kept := map[string]bool{}
+		n := 0
+		dels := []string{}
+		conflict := -1
+		for _, tpl := range has {
+			if n < limit && wants[n] == tpl && !kept[tpl] && !containsString(dels, tpl) {
+				kept[tpl] = true
+				n++
+				continue
+			}
+			if (!containsString(wants, tpl) && keep(tpl)) || containsString(dels, tpl) {
+				continue
+			}
+			// Deleting a template removes all its copies
+			if kept[tpl] {
+				for i := 0; i < n; i++ {
+					if wants[i] == tpl {
+						conflict = i
+					}
+				}
+				break
+			}
+			dels = append(dels, tpl)
+		}
+		if conflict >= 0 {
+			limit = conflict
+			continue
+		}
+		plan := []*PlanOp{}
+		for _, tpl := range dels {
+			plan = append(plan, &PlanOp{Op: AuditDelTemplate, Key: tpl})
+		}
+		for _, tpl := range wants[n:] {
+			plan = append(plan, &PlanOp{Op: AuditAddTemplate, Key: tpl})
+		}
+		return plan
+	}
+}
+
+func formatPlan(plan []*PlanOp) string {
+	if len(plan) == 0 {
+		return "none"
+	}
+	ls := []string{}
+	for _, op := range plan {
+		key := op.Key
+		if op.Prefix != "" {
+			key = op.Prefix + " " + key
+		}
+		if op.Value != nil {
+			ls = append(ls, fmt.Sprintf("%s %s=%s", op.Op, key, jsonValue(op.Value)))
+		} else {
+			ls = append(ls, fmt.Sprintf("%s %s", op.Op, key))
+		}
+	}
+	return strings.Join(ls, ", ")
+}
@@ -0,0 +1,162 @@
+package nxusercheck
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"sort"
+	"strings"
+	"text/template"
+)
+
+// TemplateData is what report templates are executed against: the report of
+// the run and its stats.
+type TemplateData struct {
+	*Report
+	Stats *Stats
+}
+
+type Stats struct {
+	Checks   int `json:"checks"`
+	Users    int `json:"users"`
+	Errors   int `json:"errors"`
+	Warnings int `json:"warnings"`
+	Info     int `json:"info"`
+	Exempted int `json:"exempted"`
+	Applied  int `json:"applied"`
+	Failed   int `json:"failed"`
+	Retries  int `json:"retries"`
+}
+
+func (r *Report) Stats() *Stats {
+	st := &Stats{Checks: len(r.Checks)}
+	st.Applied, st.Failed = r.applySummary()
+	for _, cr := range r.Checks {
+		st.Users += len(cr.Users)
+		st.Retries += cr.Retries
+		for _, ur := range cr.Users {
+			st.Exempted += len(ur.Exempted)
+			st.Retries += ur.Retries
+			for _, f := range ur.Findings {
+				switch f.Severity {
+				case SeverityError:
+					st.Errors++
+				case SeverityWarning:
+					st.Warnings++
+				case SeverityInfo:
+					st.Info++
+				}
+			}
+		}
+	}
+	return st
+}
+
+var templateFuncs = template.FuncMap{
+	"json":    jsonValue,
+	"join":    strings.Join,
+	"sortBy":  sortBy,
+	"groupBy": groupBy,
+	"findings": func(r *Report) []*Finding {
+		fs := []*Finding{}
+		for _, cr := range r.Checks {
+			for _, ur := range cr.Users {
+				fs = append(fs, ur.Findings...)
+			}
+		}
+		return fs
+	},
+	"users": func(r *Report) []*UserReport {
+		urs := []*UserReport{}
+		for _, cr := range r.Checks {
+			urs = append(urs, cr.Users...)
+		}
+		return urs
+	},
+}
+
+func parseReportTemplate(text string) (*template.Template, error) {
+	tmpl, err := template.New("report").Funcs(templateFuncs).Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing template: %s", err.Error())
+	}
+	return tmpl, nil
+}
+
+// RenderTemplate executes a text/template against a report. Besides the
+// builtin functions templates can use json, join, sortBy "Field" list,
+// groupBy "Field" list (a map from the field values to the elements) and
+// findings/users (all the findings or user reports of a report).
+func RenderTemplate(report *Report, text string) (string, error) {
+	tmpl, err := parseReportTemplate(text)
+	if err != nil {
+		return "", err
+	}
+	buf := &bytes.Buffer{}
+	if err = tmpl.Execute(buf, &TemplateData{Report: report, Stats: report.Stats()}); err != nil {
+		return "", fmt.Errorf("Error executing template: %s", err.Error())
+	}
+	return buf.String(), nil
+}
+
+func (opts *CheckOpts) template() (string, error) {
+	if opts.Template != "" || opts.TemplateFile == "" {
+		return opts.Template, nil
+	}
+	byteValue, err := ioutil.ReadFile(opts.TemplateFile)
+	if err != nil {
+		return "", fmt.Errorf("Error reading template file %s: %s", opts.TemplateFile, err.Error())
+	}
+	return string(byteValue), nil
+}
+
+func fieldValue(v reflect.Value, field string) reflect.Value {
+	for v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return reflect.Value{}
+		}
+		v = v.Elem()
+	}
+	switch v.Kind() {
+	case reflect.Struct:
+		return v.FieldByName(field)
+	case reflect.Map:
+		return v.MapIndex(reflect.ValueOf(field))
+	}
+	return reflect.Value{}
+}
+
+func fieldString(v reflect.Value, field string) string {
+	fv := fieldValue(v, field)
+	if !fv.IsValid() {
+		return ""
+	}
+	return fmt.Sprintf("%v", fv.Interface())
+}
+
+func sortBy(field string, list interface{}) (interface{}, error) {
+	lv := reflect.ValueOf(list)
+	if lv.Kind() != reflect.Slice {
+		return nil, fmt.Errorf("sortBy: %T is not a list", list)
+	}
+	sorted := reflect.MakeSlice(lv.Type(), lv.Len(), lv.Len())
+	reflect.Copy(sorted, lv)
+	sort.SliceStable(sorted.Interface(), func(i, j int) bool {
+		return fieldString(sorted.Index(i), field) < fieldString(sorted.Index(j), field)
+	})
+	return sorted.Interface(), nil
+}
+
+func groupBy(field string, list interface{}) (map[string][]interface{}, error) {
+	lv := reflect.ValueOf(list)
+	if lv.Kind() != reflect.Slice {
+		return nil, fmt.Errorf("groupBy: %T is not a list", list)
+	}
+	groups := map[string][]interface{}{}
+	for i := 0; i < lv.Len(); i++ {
+		key := fieldString(lv.Index(i), field)
+		groups[key] = append(groups[key], lv.Index(i).Interface())
+	}
+	return groups, nil
+}
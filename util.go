@@ -16,3 +16,10 @@ func randomPass(sz int) string {
 	}
 	return hex.EncodeToString(b)
 }
+
+func firstOpts(opts []*CheckOpts) *CheckOpts {
+	if len(opts) > 0 && opts[0] != nil {
+		return opts[0]
+	}
+	return &CheckOpts{}
+}